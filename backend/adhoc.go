@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// 任务类型, 早期的任务没有记录类型, 都是 playbook
+const (
+	TaskKindPlaybook = "playbook"
+	TaskKindAdhoc    = "adhoc"
+)
+
+// AdhocCommand 是一条 ansible ad-hoc 命令: ansible <pattern> -m <module> -a <args>
+type AdhocCommand struct {
+	Module  string `json:"module"`
+	Args    string `json:"args,omitempty"`
+	Pattern string `json:"pattern"` // 主机模式, 例如 all 或 web:&prod
+}
+
+// AdhocRequest 是 /adhoc 的请求体
+type AdhocRequest struct {
+	Module            string   `json:"module"`
+	Args              string   `json:"args"`
+	Pattern           string   `json:"pattern"`
+	Inventory         string   `json:"inventory"`
+	InventoryTemplate string   `json:"inventory_template"` // 使用已保存的 inventory 模板, 设置后忽略 Inventory
+	Secrets           []string `json:"secrets"`
+	CredentialID      int      `json:"credential_id"`
+	Become            bool     `json:"become"`
+	BecomeUser        string   `json:"become_user"`
+	Forks             int      `json:"forks"`
+	Verbosity         int      `json:"verbosity"`
+	Timeout           Duration `json:"timeout"`
+	Environment       string   `json:"execution_environment"` // 执行环境名称
+
+	Env map[string]string `json:"env"` // 额外的环境变量, 名称需要在 run_env_allowlist 中
+}
+
+var modulePattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// runRequest 转换为运行请求, 与 playbook 使用相同的准备、审批和执行流程
+func (a AdhocRequest) runRequest() AnsibleRequest {
+	return AnsibleRequest{
+		Inventory:         a.Inventory,
+		InventoryTemplate: a.InventoryTemplate,
+		Secrets:           a.Secrets,
+		CredentialID:      a.CredentialID,
+		Timeout:           a.Timeout,
+		Adhoc:             &AdhocCommand{Module: a.Module, Args: a.Args, Pattern: a.Pattern},
+		RunOptions: RunOptions{
+			Become:     a.Become,
+			BecomeUser: a.BecomeUser,
+			Forks:      a.Forks,
+			Verbosity:  a.Verbosity,
+		},
+		ExecutionEnvironment: a.Environment,
+		Env:                  a.Env,
+	}
+}
+
+// moduleAllowed 按配置的允许和禁止列表检查模块, 列表中可以写短名称 (shell) 或完整名称
+// (ansible.builtin.shell); 禁止列表优先, 允许列表为空时允许所有未禁止的模块
+func moduleAllowed(module string) bool {
+	short := module
+	if i := strings.LastIndex(module, "."); i >= 0 {
+		short = module[i+1:]
+	}
+	matches := func(list []string) bool {
+		for _, name := range list {
+			if name == module || name == short {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(serverConfig.AdhocDeniedModules) {
+		return false
+	}
+	return len(serverConfig.AdhocAllowedModules) == 0 || matches(serverConfig.AdhocAllowedModules)
+}
+
+// validate 检查 ad-hoc 命令
+func (c AdhocCommand) validate() error {
+	if !modulePattern.MatchString(c.Module) {
+		return fmt.Errorf("invalid module %q", c.Module)
+	}
+	if c.Pattern == "" || strings.HasPrefix(c.Pattern, "-") || !limitPattern.MatchString(c.Pattern) {
+		return fmt.Errorf("invalid host pattern %q", c.Pattern)
+	}
+	return nil
+}
+
+// args 返回放在 ansible 命令最后的参数
+func (c AdhocCommand) args() []string {
+	args := []string{"-m", c.Module}
+	if c.Args != "" {
+		args = append(args, "-a", c.Args)
+	}
+	return append(args, c.Pattern)
+}
+
+func adhocHandler(w http.ResponseWriter, r *http.Request) {
+	var adhoc AdhocRequest
+	if err := json.NewDecoder(r.Body).Decode(&adhoc); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req := adhoc.runRequest()
+	if err := req.Adhoc.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := resolveRunTemplates(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Inventory == "" {
+		http.Error(w, "inventory or inventory_template is required", http.StatusBadRequest)
+		return
+	}
+	if !moduleAllowed(req.Adhoc.Module) {
+		fmt.Printf("[Go] 拒绝未允许的 ad-hoc 模块: %s\n", req.Adhoc.Module)
+		recordAuditOutcome(r, "adhoc", "module/"+req.Adhoc.Module, AuditOutcomeDenied, "module is not allowed")
+		http.Error(w, fmt.Sprintf("Module %q is not allowed", req.Adhoc.Module), http.StatusForbidden)
+		return
+	}
+
+	// ad-hoc 命令不属于任何 playbook 模板, 需要不限 playbook 的执行权限
+	if !authorizeRun(w, r, req) {
+		return
+	}
+	serveRun(w, r, req)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	ANSIBLE_CFG_FILE = "/ansible_cfg.json" // 全局的 ansible.cfg 设置
+
+	runAnsibleCfgFile = "ansible.cfg" // 写入运行目录, 与 playbook.yml 相邻
+)
+
+// AnsibleConfig 是按节保存的 ansible.cfg 设置, 例如 {"defaults": {"host_key_checking": "False"}}
+type AnsibleConfig map[string]map[string]string
+
+var (
+	globalAnsibleConfig AnsibleConfig
+	ansibleConfigMutex  sync.Mutex
+)
+
+var ansibleCfgNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// ansibleCfgAllowedKeys 是受管的 ansible.cfg 可以修改的设置 (按节);
+// 指向控制节点文件、插件目录或在控制节点上执行命令的设置 (例如 ssh_args、ssh_executable、proxy_command) 都不在其中
+var ansibleCfgAllowedKeys = map[string]map[string]bool{
+	"defaults": setOf(
+		"forks", "host_key_checking", "timeout", "gathering", "gather_subset", "gather_timeout", "remote_user",
+		"poll_interval", "internal_poll_interval", "strategy", "task_timeout", "any_errors_fatal", "force_handlers",
+		"error_on_undefined_vars", "hash_behaviour", "jinja2_native", "duplicate_dict_key", "private_role_vars",
+		"stdout_callback", "callbacks_enabled", "callback_whitelist", "callback_result_format", "bin_ansible_callbacks",
+		"display_skipped_hosts", "display_ok_hosts", "display_args_to_stdout", "show_custom_stats", "max_diff_size",
+		"retry_files_enabled", "deprecation_warnings", "system_warnings", "command_warnings", "localhost_warning",
+		"nocows", "nocolor", "force_color",
+	),
+	"ssh_connection":        setOf("pipelining", "retries", "transfer_method", "scp_if_ssh", "usetty"),
+	"persistent_connection": setOf("connect_timeout", "command_timeout"),
+	"privilege_escalation":  setOf("become", "become_method", "become_user"),
+	"diff":                  setOf("always", "context"),
+	"inventory":             setOf("any_unparsed_is_failed", "unparsed_is_failed"),
+}
+
+func setOf(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+func ansibleConfigPath() string {
+	return filepath.Join(DATA_DIR, ANSIBLE_CFG_FILE)
+}
+
+func loadAnsibleConfig() error {
+	data, err := ioutil.ReadFile(ansibleConfigPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &globalAnsibleConfig); err != nil {
+		return fmt.Errorf("invalid ansible.cfg settings: %v", err)
+	}
+	return globalAnsibleConfig.validate()
+}
+
+// validate 检查节名、设置名和值; 值不能包含换行
+func (c AnsibleConfig) validate() error {
+	for section, settings := range c {
+		if !ansibleCfgNamePattern.MatchString(section) {
+			return fmt.Errorf("invalid ansible.cfg section %q", section)
+		}
+		for key, value := range settings {
+			if !ansibleCfgNamePattern.MatchString(key) {
+				return fmt.Errorf("invalid ansible.cfg key %s.%s", section, key)
+			}
+			if !ansibleCfgAllowedKeys[section][key] {
+				return fmt.Errorf("ansible.cfg key %s.%s is not allowed", section, key)
+			}
+			if strings.ContainsAny(value, "\r\n\x00") {
+				return fmt.Errorf("ansible.cfg value of %s.%s must be a single line", section, key)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeAnsibleConfig 按顺序合并多层设置, 后面的同名设置覆盖前面的
+func mergeAnsibleConfig(layers ...AnsibleConfig) AnsibleConfig {
+	merged := AnsibleConfig{}
+	for _, layer := range layers {
+		for section, settings := range layer {
+			if merged[section] == nil {
+				merged[section] = map[string]string{}
+			}
+			for key, value := range settings {
+				merged[section][key] = value
+			}
+		}
+	}
+	return merged
+}
+
+// render 生成 ansible.cfg 内容, 节和设置按名称排序
+func (c AnsibleConfig) render() string {
+	var b strings.Builder
+	b.WriteString("# 由 ansible-web 生成\n")
+	sections := make([]string, 0, len(c))
+	for section := range c {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		keys := make([]string, 0, len(c[section]))
+		for key := range c[section] {
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(&b, "\n[%s]\n", section)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s = %s\n", key, c[section][key])
+		}
+	}
+	return b.String()
+}
+
+// parseAnsibleConfig 解析 ansible.cfg, 支持 [section]、key = value (或 key: value)、# 和 ; 注释,
+// 以及以空白开头的续行
+func parseAnsibleConfig(data []byte) AnsibleConfig {
+	config := AnsibleConfig{}
+	section, lastKey := "", ""
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section, lastKey = strings.TrimSpace(line[1:len(line)-1]), ""
+			if config[section] == nil {
+				config[section] = map[string]string{}
+			}
+			continue
+		}
+		if section == "" {
+			continue
+		}
+		if raw[0] == ' ' || raw[0] == '\t' {
+			if lastKey != "" {
+				config[section][lastKey] += " " + line
+			}
+			continue
+		}
+		idx := strings.IndexAny(line, "=:")
+		if idx < 0 {
+			continue
+		}
+		lastKey = strings.TrimSpace(line[:idx])
+		config[section][lastKey] = strings.TrimSpace(line[idx+1:])
+	}
+	return config
+}
+
+// runAnsibleConfig 返回一次运行的 ansible.cfg 设置: 执行环境的 ansible_config 文件 < 全局 < inventory 模板 < playbook 模板;
+// 都没有设置时返回 nil, 保持 ansible 默认的配置文件查找
+func runAnsibleConfig(req AnsibleRequest, environment *ExecutionEnvironment) (AnsibleConfig, error) {
+	ansibleConfigMutex.Lock()
+	layers := []AnsibleConfig{globalAnsibleConfig}
+	ansibleConfigMutex.Unlock()
+
+	if req.InventoryTemplate != "" {
+		if template, ok := findTemplate("inventory", req.InventoryTemplate); ok {
+			layers = append(layers, template.AnsibleConfig)
+		}
+	}
+	if req.PlaybookTemplate != "" && req.Adhoc == nil {
+		if template, ok := findTemplate("playbook", req.PlaybookTemplate); ok {
+			layers = append(layers, template.AnsibleConfig)
+		}
+	}
+	managed := mergeAnsibleConfig(layers...)
+	if len(managed) == 0 {
+		return nil, nil
+	}
+	// 允许的设置可能比保存时更少, 运行前重新检查
+	if err := managed.validate(); err != nil {
+		return nil, err
+	}
+
+	// 受管的 ansible.cfg 通过 ANSIBLE_CONFIG 指定, 会替代执行环境的配置文件, 因此以其内容为基础
+	if environment != nil && environment.AnsibleConfig != "" {
+		data, err := ioutil.ReadFile(environment.AnsibleConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ansible_config of execution environment %s: %v", environment.Name, err)
+		}
+		return mergeAnsibleConfig(parseAnsibleConfig(data), managed), nil
+	}
+	return managed, nil
+}
+
+// runEnvAllowed 判断运行请求能否设置环境变量, run_env_allowlist 中的名称支持 * 通配
+func runEnvAllowed(name string) bool {
+	for _, pattern := range serverConfig.RunEnvAllowlist {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRunEnv 检查运行请求中的环境变量
+func validateRunEnv(env map[string]string) error {
+	for name, value := range env {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+		if !runEnvAllowed(name) {
+			return fmt.Errorf("environment variable %s is not allowed", name)
+		}
+		if strings.ContainsRune(value, 0) {
+			return fmt.Errorf("invalid value of environment variable %s", name)
+		}
+	}
+	return nil
+}
+
+// serverEnv 返回传给 ansible 进程的服务端环境变量, 去掉 ANSIBLE_WEB_ 开头的服务配置 (例如管理员密码和主密钥)
+func serverEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, configEnvPrefix) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+func getAnsibleConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ansibleConfigMutex.Lock()
+	defer ansibleConfigMutex.Unlock()
+	config := globalAnsibleConfig
+	if config == nil {
+		config = AnsibleConfig{}
+	}
+	json.NewEncoder(w).Encode(config)
+}
+
+// updateAnsibleConfigHandler 替换全局的 ansible.cfg 设置
+func updateAnsibleConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var config AnsibleConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := config.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ansibleConfigMutex.Lock()
+	defer ansibleConfigMutex.Unlock()
+
+	if err := writeJSONFile(ansibleConfigPath(), config); err != nil {
+		fmt.Printf("[Go] 保存 ansible.cfg 设置失败: %v\n", err)
+		http.Error(w, "Failed to save ansible.cfg settings", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "ansible_cfg.update", "ansible_cfg", globalAnsibleConfig, config)
+	globalAnsibleConfig = config
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	PROTECTION_CONFIG_FILE = "/protection.json" // 受保护的 inventory 和主机组
+
+	TaskStatusAwaitingApproval TaskStatus = "awaiting_approval"
+	TaskStatusRejected         TaskStatus = "rejected"
+)
+
+// ProtectionRules 列出需要审批才能执行的 inventory 模板和主机组, 支持 * 通配
+type ProtectionRules struct {
+	Inventories []string `json:"inventories"`
+	Groups      []string `json:"groups"`
+}
+
+// TaskApproval 记录任务的审批过程
+type TaskApproval struct {
+	RequestedBy string     `json:"requested_by"`
+	RequestedAt time.Time  `json:"requested_at"`
+	Decision    string     `json:"decision,omitempty"` // approved 或 rejected
+	DecidedBy   string     `json:"decided_by,omitempty"`
+	DecidedAt   *time.Time `json:"decided_at,omitempty"`
+	Comment     string     `json:"comment,omitempty"`
+}
+
+var (
+	protectionRules ProtectionRules
+	protectionMutex sync.Mutex
+
+	// 等待审批的运行请求, 审批通过后按原样执行, 不受之后模板修改的影响;
+	// 请求同时由 dispatchRun 加密保存, 重启后由 restorePendingRuns 恢复
+	pendingRuns      = map[int]AnsibleRequest{}
+	pendingRunsMutex sync.Mutex
+)
+
+func protectionConfigPath() string {
+	return filepath.Join(DATA_DIR, PROTECTION_CONFIG_FILE)
+}
+
+// loadProtectionRules 加载受保护的 inventory 和主机组配置
+func loadProtectionRules() error {
+	data, err := ioutil.ReadFile(protectionConfigPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &protectionRules); err != nil {
+		return fmt.Errorf("invalid protection config: %v", err)
+	}
+	return nil
+}
+
+// inventoryHostVarPattern 匹配 inventory 行中的 ansible_host / ansible_ssh_host 设置
+var inventoryHostVarPattern = regexp.MustCompile(`\bansible_(?:ssh_)?host=["']?([^\s"']+)`)
+
+// requiresApproval 判断运行是否涉及受保护的 inventory 模板、主机组或主机组中的已登记主机。
+// 请求中的 inventory 可以随意命名主机组, 因此还要把其中的主机名和 ansible_host 地址
+// 与服务端登记的主机对照, 按主机登记的主机组判断
+func requiresApproval(req AnsibleRequest) bool {
+	protectionMutex.Lock()
+	rules := protectionRules
+	protectionMutex.Unlock()
+
+	if len(rules.Inventories) > 0 && matchTemplateName(rules.Inventories, req.InventoryTemplate) {
+		return true
+	}
+	if len(rules.Groups) == 0 {
+		return false
+	}
+	for _, group := range inventoryGroups(req.Inventory) {
+		if matchPatterns(rules.Groups, group) {
+			return true
+		}
+	}
+
+	targets := map[string]bool{}
+	for _, hostname := range inventoryHosts(req.Inventory) {
+		targets[hostname] = true
+	}
+	for _, match := range inventoryHostVarPattern.FindAllStringSubmatch(req.Inventory, -1) {
+		targets[match[1]] = true
+	}
+	for _, name := range []string{"ansible_host", "ansible_ssh_host"} {
+		if address, ok := req.Variables[name].(string); ok {
+			targets[address] = true
+		}
+	}
+
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+	for _, host := range hosts {
+		if !targets[host.Hostname] && (host.IP == "" || !targets[host.IP]) {
+			continue
+		}
+		if matchPatterns(rules.Groups, hostGroupScope(host).Groups[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestApproval 生成 --check --diff 预览并将任务置为等待审批
+func requestApproval(taskID int, req AnsibleRequest, run *preparedRun, sink runSink) {
+	fmt.Printf("[Go] 任务 #%d 涉及受保护的 inventory, 生成 --check --diff 预览\n", taskID)
+	addTaskLog(taskID, "运行涉及受保护的 inventory 或主机组, 生成 --check --diff 预览", "info")
+
+	// 预览同样受并发限制, 但不占用 inventory 和主机组的锁
+	release, err := waitForRunSlot(taskID, nil, sink)
+	if err != nil {
+		cancelTask(taskID, err)
+		return
+	}
+	preview, err := run.run([]string{"--check", "--diff"}, sink)
+	release()
+	if err != nil {
+		preview += err.Error()
+	}
+
+	var requestedBy string
+	updateTask(taskID, func(task *Task) {
+		requestedBy = task.Username
+		task.Status = TaskStatusAwaitingApproval
+		task.Preview = preview
+		task.Approval = &TaskApproval{
+			RequestedBy: task.Username,
+			RequestedAt: time.Now(),
+		}
+	})
+
+	pendingRunsMutex.Lock()
+	pendingRuns[taskID] = req
+	pendingRunsMutex.Unlock()
+
+	addTaskLog(taskID, fmt.Sprintf("等待审批, 申请人 %s", requestedBy), "info")
+	addNotification(NotificationTypeWarning, fmt.Sprintf("任务 #%d 等待审批 (申请人 %s)", taskID, requestedBy))
+}
+
+// restorePendingRuns 恢复服务重启前等待审批的任务; 工作流节点无法回到工作流中继续,
+// 读取不到运行请求的任务也无法执行, 这些任务标记为已取消
+func restorePendingRuns() {
+	var awaiting []Task
+	tasksMutex.Lock()
+	for _, task := range tasks {
+		if task.Status == TaskStatusAwaitingApproval {
+			awaiting = append(awaiting, task)
+		}
+	}
+	tasksMutex.Unlock()
+
+	pendingRunsMutex.Lock()
+	defer pendingRunsMutex.Unlock()
+	for _, task := range awaiting {
+		if task.WorkflowTaskID != 0 {
+			cancelTask(task.ID, fmt.Errorf("Interrupted by server restart: workflow task #%d cannot continue", task.WorkflowTaskID))
+			continue
+		}
+		req, err := loadTaskRequest(task.ID)
+		if err != nil {
+			fmt.Printf("[Go] 读取等待审批的任务 #%d 的运行请求失败: %v\n", task.ID, err)
+			cancelTask(task.ID, fmt.Errorf("Interrupted by server restart: the run request is not available"))
+			continue
+		}
+		pendingRuns[task.ID] = req
+	}
+	if len(pendingRuns) > 0 {
+		fmt.Printf("[Go] 恢复 %d 个等待审批的任务\n", len(pendingRuns))
+	}
+}
+
+// decideTaskHandler 处理审批和拒绝, 审批人必须是申请人以外、对该运行有执行权限的用户
+func decideTaskHandler(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID      int    `json:"id"`
+			Comment string `json:"comment"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		user, _ := currentUser(r)
+		if user.ID == 0 {
+			http.Error(w, "Approvals require a user account", http.StatusForbidden)
+			return
+		}
+		if approve && runsDraining() {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		pendingRunsMutex.Lock()
+		defer pendingRunsMutex.Unlock()
+
+		pending, ok := pendingRuns[req.ID]
+		if !ok {
+			http.Error(w, "Task is not awaiting approval", http.StatusNotFound)
+			return
+		}
+		if !authorizeRun(w, r, pending) {
+			return
+		}
+
+		var before, after Task
+		var denied bool
+		now := time.Now()
+		updateTask(req.ID, func(task *Task) {
+			if task.UserID == user.ID {
+				denied = true
+				return
+			}
+			before = *task
+			task.Approval.DecidedBy = user.Username
+			task.Approval.DecidedAt = &now
+			task.Approval.Comment = req.Comment
+			if approve {
+				task.Approval.Decision = "approved"
+				task.Status = TaskStatusPending
+			} else {
+				task.Approval.Decision = "rejected"
+				task.Status = TaskStatusRejected
+				task.EndTime = &now
+			}
+			after = *task
+		})
+		if denied {
+			recordAuditOutcome(r, "task.approve", fmt.Sprintf("task/%d", req.ID), AuditOutcomeDenied, "requester cannot approve their own run")
+			http.Error(w, "The requester cannot approve or reject their own run", http.StatusForbidden)
+			return
+		}
+		delete(pendingRuns, req.ID)
+
+		if approve {
+			fmt.Printf("[Go] 任务 #%d 已由 %s 审批通过\n", req.ID, user.Username)
+			addTaskLog(req.ID, fmt.Sprintf("已由 %s 审批通过: %s", user.Username, req.Comment), "info")
+			addNotification(NotificationTypeInfo, fmt.Sprintf("任务 #%d 已由 %s 审批通过", req.ID, user.Username))
+			recordAudit(r, "task.approve", fmt.Sprintf("task/%d", req.ID), before, after)
+			taskID := req.ID
+			if !startBackgroundRun(func() { runApprovedTask(taskID, pending) }) {
+				failTask(taskID, fmt.Errorf("server is shutting down"))
+			}
+		} else {
+			fmt.Printf("[Go] 任务 #%d 已被 %s 拒绝\n", req.ID, user.Username)
+			addTaskLog(req.ID, fmt.Sprintf("已被 %s 拒绝: %s", user.Username, req.Comment), "warning")
+			addNotification(NotificationTypeWarning, fmt.Sprintf("任务 #%d 已被 %s 拒绝", req.ID, user.Username))
+			recordAudit(r, "task.reject", fmt.Sprintf("task/%d", req.ID), before, after)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(after)
+	}
+}
+
+// runApprovedTask 在后台执行已审批的任务, 输出只记录到任务日志
+func runApprovedTask(taskID int, req AnsibleRequest) {
+	run, err := prepareRun(req)
+	if err != nil {
+		fmt.Printf("[Go] 准备运行失败: %v\n", err)
+		failTask(taskID, err)
+		return
+	}
+	defer run.cleanup()
+	executeTask(taskID, run, nil)
+}
+
+func getProtectionRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	protectionMutex.Lock()
+	defer protectionMutex.Unlock()
+	json.NewEncoder(w).Encode(protectionRules)
+}
+
+// updateProtectionRulesHandler 替换受保护的 inventory 和主机组配置
+func updateProtectionRulesHandler(w http.ResponseWriter, r *http.Request) {
+	var rules ProtectionRules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := validatePermissions(UserRoleViewer, []Permission{{Action: ActionRun, Inventories: rules.Inventories, Groups: rules.Groups}}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	protectionMutex.Lock()
+	defer protectionMutex.Unlock()
+
+	if err := writeJSONFile(protectionConfigPath(), rules); err != nil {
+		fmt.Printf("[Go] 保存保护配置失败: %v\n", err)
+		http.Error(w, "Failed to save protection rules", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "protection.update", "protection", protectionRules, rules)
+	protectionRules = rules
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
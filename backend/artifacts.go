@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	artifactsFile       = "artifacts.json"
+	artifactsPluginFile = "ansible_web_artifacts.py"
+)
+
+// artifactsPlugin 是写入运行目录 callback_plugins/ 的回调插件; 与 playbook 相邻的插件目录会被自动加载,
+// 不需要 ANSIBLE_CALLBACKS_ENABLED, 也不会覆盖 ansible.cfg 中启用的其他回调
+const artifactsPlugin = `# ansible-web: 将 set_stats 的汇总数据 (per_host: no) 写入运行目录的 artifacts.json
+import json
+import os
+
+from ansible.plugins.callback import CallbackBase
+
+
+class CallbackModule(CallbackBase):
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = 'aggregate'
+    CALLBACK_NAME = 'ansible_web_artifacts'
+    CALLBACK_NEEDS_ENABLED = False
+    CALLBACK_NEEDS_WHITELIST = False
+
+    def v2_playbook_on_stats(self, stats):
+        artifacts = (stats.custom or {}).get('_run') or {}
+        path = os.path.join(os.path.dirname(os.path.abspath(__file__)), '..', 'artifacts.json')
+        with open(path, 'w') as f:
+            json.dump(artifacts, f, default=str)
+`
+
+// prepareRunArtifacts 写入收集 set_stats 数据的回调插件
+func prepareRunArtifacts(tmpDir string) error {
+	dir := filepath.Join(tmpDir, "callback_plugins")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, artifactsPluginFile), []byte(artifactsPlugin), 0600)
+}
+
+// artifacts 返回运行中 set_stats 设置的数据, 机密值已脱敏; 没有数据时返回 nil
+func (p *preparedRun) artifacts() map[string]interface{} {
+	data, err := ioutil.ReadFile(filepath.Join(p.Dir, artifactsFile))
+	if err != nil {
+		return nil
+	}
+	var artifacts map[string]interface{}
+	if err := json.Unmarshal([]byte(p.Redactor.Redact(string(data))), &artifacts); err != nil || len(artifacts) == 0 {
+		return nil
+	}
+	return artifacts
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_LOG_FILE = "/audit.jsonl" // 审计日志, 每行一条记录, 只追加不修改
+
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailed  = "failed" // 例如登录失败
+	AuditOutcomeDenied  = "denied" // 没有权限或请求被安全检查拒绝
+
+	defaultAuditQueryLimit = 500
+)
+
+// AuditEntry 是一条审计记录; Before 和 After 是操作前后对象的摘要, 不保存内容本身
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+	UserID    int       `json:"user_id,omitempty"`
+	TokenID   int       `json:"token_id,omitempty"`
+	Action    string    `json:"action"` // 例如 host.add, template.update, run
+	Target    string    `json:"target"` // 例如 host/3, template/playbook/deploy
+	Outcome   string    `json:"outcome"`
+	Before    string    `json:"before,omitempty"`
+	After     string    `json:"after,omitempty"`
+	IP        string    `json:"ip"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+var (
+	auditFile  *os.File
+	auditID    int
+	auditMutex sync.Mutex
+)
+
+// openAuditLog 以追加模式打开审计日志, 并从已有记录中恢复 ID
+func openAuditLog() error {
+	path := filepath.Join(DATA_DIR, AUDIT_LOG_FILE)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil && entry.ID > auditID {
+			auditID = entry.ID
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+
+	auditFile = file
+	return nil
+}
+
+// auditDigest 返回对象 JSON 的 SHA-256 摘要, nil 返回空字符串
+func auditDigest(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// clientIP 返回请求的来源 IP
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// recordAudit 记录一次成功的修改操作, before/after 为操作前后的对象, 新增时 before 为 nil, 删除时 after 为 nil
+func recordAudit(r *http.Request, action, target string, before, after interface{}) {
+	writeAudit(r, AuditEntry{
+		Action:  action,
+		Target:  target,
+		Outcome: AuditOutcomeSuccess,
+		Before:  auditDigest(before),
+		After:   auditDigest(after),
+	})
+}
+
+// recordAuditOutcome 记录失败或被拒绝的操作
+func recordAuditOutcome(r *http.Request, action, target, outcome, detail string) {
+	writeAudit(r, AuditEntry{
+		Action:  action,
+		Target:  target,
+		Outcome: outcome,
+		Detail:  detail,
+	})
+}
+
+// writeAudit 写入一条审计记录; r 为 nil 时 (例如定时计划发起的运行) 使用 entry 中的操作者
+func writeAudit(r *http.Request, entry AuditEntry) {
+	if r != nil {
+		if user, ok := currentUser(r); ok {
+			entry.Actor = user.Username
+			entry.UserID = user.ID
+		}
+		if token, ok := currentToken(r); ok {
+			entry.TokenID = token.ID
+		}
+		entry.IP = clientIP(r)
+	}
+	entry.Timestamp = time.Now()
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	auditID++
+	entry.ID = auditID
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("[Go] 序列化审计记录失败: %s %s by %s: %v\n", entry.Action, entry.Target, entry.Actor, err)
+		return
+	}
+	// 审计日志在启动时打开, 打开失败时服务不会启动; 在此之前的记录只能输出到终端
+	if auditFile == nil {
+		fmt.Printf("[Go] 审计日志未打开, 记录未写入: %s\n", data)
+		return
+	}
+	if _, err := auditFile.Write(append(data, '\n')); err != nil {
+		fmt.Printf("[Go] 写入审计日志失败: %v, 记录: %s\n", err, data)
+	}
+}
+
+// auditFilter 是 /audit 的查询条件, 为空的条件不过滤
+type auditFilter struct {
+	actor   string
+	action  string // 支持前缀, 例如 host. 匹配所有主机操作
+	target  string // 支持前缀
+	outcome string
+	since   time.Time
+	until   time.Time
+}
+
+func (f auditFilter) match(entry AuditEntry) bool {
+	if f.actor != "" && entry.Actor != f.actor {
+		return false
+	}
+	if f.action != "" && entry.Action != f.action && !(strings.HasSuffix(f.action, ".") && strings.HasPrefix(entry.Action, f.action)) {
+		return false
+	}
+	if f.target != "" && !strings.HasPrefix(entry.Target, f.target) {
+		return false
+	}
+	if f.outcome != "" && entry.Outcome != f.outcome {
+		return false
+	}
+	if !f.since.IsZero() && entry.Timestamp.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && entry.Timestamp.After(f.until) {
+		return false
+	}
+	return true
+}
+
+func parseAuditFilter(r *http.Request) (auditFilter, error) {
+	query := r.URL.Query()
+	filter := auditFilter{
+		actor:   query.Get("actor"),
+		action:  query.Get("action"),
+		target:  query.Get("target"),
+		outcome: query.Get("outcome"),
+	}
+	for _, field := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &filter.since}, {"until", &filter.until}} {
+		if raw := query.Get(field.name); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s, expected RFC3339", field.name)
+			}
+			*field.value = t
+		}
+	}
+	return filter, nil
+}
+
+// getAuditHandler 查询审计日志, 支持 actor/action/target/outcome/since/until/limit 过滤;
+// format=jsonl 时以 JSONL 格式导出所有匹配的记录, 否则返回最近 limit 条
+func getAuditHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	export := r.URL.Query().Get("format") == "jsonl"
+	limit := defaultAuditQueryLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 单独打开文件读取, 不影响写入
+	file, err := os.Open(filepath.Join(DATA_DIR, AUDIT_LOG_FILE))
+	if err != nil {
+		http.Error(w, "Failed to open audit log", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	if export {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	}
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || !filter.match(entry) {
+			continue
+		}
+		if export {
+			w.Write(scanner.Bytes())
+			w.Write([]byte("\n"))
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	if export {
+		return
+	}
+
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
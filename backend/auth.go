@@ -0,0 +1,687 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	USER_DATA_DIR = "/users" // 用户数据子目录
+
+	adminPasswordEnv = "ANSIBLE_WEB_ADMIN_PASSWORD" // 首次启动时创建的 admin 用户密码
+
+	sessionCookieName  = "ansible_web_session"
+	sessionTokenPrefix = "sess_"
+
+	passwordHashIterations = 600000
+	minPasswordLength      = 8
+)
+
+// User 是对外可见的用户信息, 不包含密码哈希
+type User struct {
+	ID          int          `json:"id"`
+	Username    string       `json:"username"`
+	Role        UserRole     `json:"role"`
+	Permissions []Permission `json:"permissions"` // 在角色之外单独授予的权限
+	Disabled    bool         `json:"disabled"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// storedUser 是持久化到磁盘的用户
+type storedUser struct {
+	User
+	PasswordHash string `json:"password_hash"`
+}
+
+// UserRequest 是新增和更新用户的请求体;
+// 更新时 Password 为空表示不修改密码, Role 为空或未提供 Permissions 表示不修改
+type UserRequest struct {
+	ID          int          `json:"id"`
+	Username    string       `json:"username"`
+	Password    string       `json:"password"`
+	Role        UserRole     `json:"role"`
+	Permissions []Permission `json:"permissions"`
+	Disabled    bool         `json:"disabled"`
+}
+
+type session struct {
+	UserID    int
+	ExpiresAt time.Time
+}
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+var (
+	users        []storedUser
+	userID       int
+	usersMutex   sync.Mutex
+	sessions     = map[string]session{} // key 为 token 的 SHA-256, 不在内存中保存明文 token
+	sessionMutex sync.Mutex
+)
+
+// 无需登录即可访问的接口
+var publicPaths = map[string]bool{
+	"/auth/login": true,
+}
+
+// hashPassword 使用 PBKDF2-SHA256 计算密码哈希, 格式为 pbkdf2-sha256$轮数$盐$哈希
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordHashIterations, 32)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key := pbkdf2SHA256([]byte(password), salt, iterations, len(expected))
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// 用户不存在时也计算一次哈希, 避免通过响应时间判断用户名是否存在
+var dummyPasswordHash, _ = hashPassword("dummy-password")
+
+func userDataPath(username string) string {
+	return filepath.Join(DATA_DIR, USER_DATA_DIR, username+".json")
+}
+
+func saveUserFile(user storedUser) error {
+	data, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := userDataPath(user.Username)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 从文件系统加载用户, 没有任何用户时创建初始 admin 用户
+func loadUsersFromFiles() error {
+	users = []storedUser{}
+
+	dir := filepath.Join(DATA_DIR, USER_DATA_DIR)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var user storedUser
+		if err := json.Unmarshal(data, &user); err != nil {
+			fmt.Printf("[Go] 跳过无效的用户文件 %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if user.ID > userID {
+			userID = user.ID
+		}
+		if user.Role == "" {
+			user.Role = UserRoleViewer
+		}
+		users = append(users, user)
+	}
+
+	if len(users) == 0 {
+		return createInitialAdmin()
+	}
+	return ensureAdminUser()
+}
+
+// ensureAdminUser 在没有可用的 admin 用户时 (例如旧版本创建的用户没有角色),
+// 将 ID 最小的未禁用用户设为 admin, 避免无人可以管理用户
+func ensureAdminUser() error {
+	if countAdmins(users, 0) > 0 {
+		return nil
+	}
+	index := -1
+	for i, user := range users {
+		if !user.Disabled && (index == -1 || user.ID < users[index].ID) {
+			index = i
+		}
+	}
+	if index == -1 {
+		return nil
+	}
+	user := users[index]
+	user.Role = UserRoleAdmin
+	if err := saveUserFile(user); err != nil {
+		return err
+	}
+	users[index] = user
+	fmt.Printf("[Go] 没有可用的 admin 用户, 已将用户 %s 设为 admin\n", user.Username)
+	return nil
+}
+
+// countAdmins 统计未禁用的 admin 用户数量, 不包括 excludeID 对应的用户
+func countAdmins(list []storedUser, excludeID int) int {
+	count := 0
+	for _, user := range list {
+		if user.ID != excludeID && user.Role == UserRoleAdmin && !user.Disabled {
+			count++
+		}
+	}
+	return count
+}
+
+// createInitialAdmin 创建 admin 用户, 密码来自环境变量, 未设置时随机生成并打印一次
+func createInitialAdmin() error {
+	password := os.Getenv(adminPasswordEnv)
+	if password == "" {
+		raw := make([]byte, 12)
+		if _, err := rand.Read(raw); err != nil {
+			return err
+		}
+		password = hex.EncodeToString(raw)
+		fmt.Printf("[Go] 已创建初始用户 admin, 密码: %s (请登录后立即修改)\n", password)
+	} else {
+		fmt.Printf("[Go] 已使用 %s 创建初始用户 admin\n", adminPasswordEnv)
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	userID++
+	user := storedUser{
+		User: User{
+			ID:        userID,
+			Username:  "admin",
+			Role:      UserRoleAdmin,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		},
+		PasswordHash: hash,
+	}
+	if err := saveUserFile(user); err != nil {
+		return err
+	}
+	users = append(users, user)
+	return nil
+}
+
+func findUserByID(id int) (User, bool) {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	for _, user := range users {
+		if user.ID == id {
+			return user.User, true
+		}
+	}
+	return User{}, false
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession 为用户创建会话, 返回明文 token
+func createSession(userID int) (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := sessionTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	expiresAt := time.Now().Add(time.Duration(serverConfig.SessionTTL))
+
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	// 顺便清理过期会话
+	for key, s := range sessions {
+		if time.Now().After(s.ExpiresAt) {
+			delete(sessions, key)
+		}
+	}
+	sessions[hashToken(token)] = session{UserID: userID, ExpiresAt: expiresAt}
+	return token, expiresAt, nil
+}
+
+// requestToken 从 Authorization: Bearer 头或会话 cookie 中取出会话 token 或 API token
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// authenticate 校验请求携带的会话或 API token, 返回对应的用户;
+// 使用 API token 时同时返回该 token
+func authenticate(r *http.Request) (User, *APIToken, bool) {
+	token := requestToken(r)
+	if token == "" {
+		return User{}, nil, false
+	}
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		user, apiToken, ok := authenticateAPIToken(token)
+		return user, &apiToken, ok
+	}
+
+	sessionMutex.Lock()
+	s, ok := sessions[hashToken(token)]
+	if ok && time.Now().After(s.ExpiresAt) {
+		delete(sessions, hashToken(token))
+		ok = false
+	}
+	sessionMutex.Unlock()
+	if !ok {
+		return User{}, nil, false
+	}
+
+	user, found := findUserByID(s.UserID)
+	if !found || user.Disabled {
+		return User{}, nil, false
+	}
+	return user, nil, true
+}
+
+// currentUser 返回认证中间件放入请求上下文的用户
+func currentUser(r *http.Request) (User, bool) {
+	user, ok := r.Context().Value(userContextKey).(User)
+	return user, ok
+}
+
+// authMiddleware 保护所有已注册的接口, 只有 publicPaths 中的接口无需登录;
+// 跨域预检请求已由 securityMiddleware 应答
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, token, ok := authenticate(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		if token != nil {
+			ctx = context.WithValue(ctx, tokenContextKey, *token)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	usersMutex.Lock()
+	var user storedUser
+	found := false
+	for _, u := range users {
+		if u.Username == req.Username {
+			user = u
+			found = true
+			break
+		}
+	}
+	usersMutex.Unlock()
+
+	if !found {
+		verifyPassword(dummyPasswordHash, req.Password)
+	}
+	if !found || user.Disabled || !verifyPassword(user.PasswordHash, req.Password) {
+		fmt.Printf("[Go] 用户 %q 登录失败, 来源 %s\n", req.Username, r.RemoteAddr)
+		writeAudit(r, AuditEntry{Actor: req.Username, Action: "auth.login", Target: "user/" + req.Username, Outcome: AuditOutcomeFailed})
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	token, expiresAt, err := createSession(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("[Go] 用户 %s 登录成功\n", user.Username)
+	writeAudit(r, AuditEntry{Actor: user.Username, UserID: user.ID, Action: "auth.login", Target: "user/" + user.Username, Outcome: AuditOutcomeSuccess})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user":       user.User,
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if token := requestToken(r); token != "" {
+		sessionMutex.Lock()
+		delete(sessions, hashToken(token))
+		sessionMutex.Unlock()
+	}
+	if user, ok := currentUser(r); ok {
+		recordAudit(r, "auth.logout", "user/"+user.Username, nil, nil)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func currentUserHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, _ := currentUser(r)
+	json.NewEncoder(w).Encode(user)
+}
+
+// changePasswordHandler 修改当前用户的密码, 并使该用户的其他会话失效
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	current, _ := currentUser(r)
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	for i := range users {
+		if users[i].ID != current.ID {
+			continue
+		}
+		if !verifyPassword(users[i].PasswordHash, req.OldPassword) {
+			http.Error(w, "Invalid password", http.StatusForbidden)
+			return
+		}
+		hash, err := hashPassword(req.NewPassword)
+		if err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+		user := users[i]
+		user.PasswordHash = hash
+		user.UpdatedAt = time.Now()
+		if err := saveUserFile(user); err != nil {
+			fmt.Printf("[Go] 保存用户文件失败: %v\n", err)
+			http.Error(w, "Failed to save user", http.StatusInternalServerError)
+			return
+		}
+		users[i] = user
+		revokeUserSessions(user.ID, requestToken(r))
+		recordAudit(r, "auth.password", "user/"+user.Username, nil, nil)
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	http.Error(w, "User not found", http.StatusNotFound)
+}
+
+// revokeUserSessions 删除用户的所有会话, keepToken 对应的会话除外
+func revokeUserSessions(userID int, keepToken string) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	keep := ""
+	if keepToken != "" {
+		keep = hashToken(keepToken)
+	}
+	for key, s := range sessions {
+		if s.UserID == userID && key != keep {
+			delete(sessions, key)
+		}
+	}
+}
+
+func getUsersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	list := make([]User, 0, len(users))
+	for _, user := range users {
+		list = append(list, user.User)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func addUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !namePattern.MatchString(req.Username) {
+		http.Error(w, "Invalid username", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = UserRoleViewer
+	}
+	if err := validatePermissions(req.Role, req.Permissions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	for _, existing := range users {
+		if existing.Username == req.Username {
+			http.Error(w, "Username already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	user := storedUser{
+		User: User{
+			ID:          userID + 1,
+			Username:    req.Username,
+			Role:        req.Role,
+			Permissions: req.Permissions,
+			Disabled:    req.Disabled,
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+		},
+		PasswordHash: hash,
+	}
+	if err := saveUserFile(user); err != nil {
+		fmt.Printf("[Go] 保存用户文件失败: %v\n", err)
+		http.Error(w, "Failed to save user", http.StatusInternalServerError)
+		return
+	}
+	userID++
+	users = append(users, user)
+	recordAudit(r, "user.add", "user/"+user.Username, nil, user.User)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user.User)
+}
+
+// updateUserHandler 修改用户的角色、权限、禁用状态和密码, 不支持修改用户名
+func updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Password != "" && len(req.Password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	for i := range users {
+		if users[i].ID != req.ID {
+			continue
+		}
+		user := users[i]
+		if req.Role != "" {
+			user.Role = req.Role
+		}
+		if req.Permissions != nil {
+			user.Permissions = req.Permissions
+		}
+		if err := validatePermissions(user.Role, user.Permissions); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user.Disabled = req.Disabled
+		if (user.Role != UserRoleAdmin || user.Disabled) && countAdmins(users, user.ID) == 0 {
+			http.Error(w, "Cannot remove the last admin", http.StatusBadRequest)
+			return
+		}
+		if req.Password != "" {
+			hash, err := hashPassword(req.Password)
+			if err != nil {
+				http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+				return
+			}
+			user.PasswordHash = hash
+		}
+		user.UpdatedAt = time.Now()
+		if err := saveUserFile(user); err != nil {
+			fmt.Printf("[Go] 保存用户文件失败: %v\n", err)
+			http.Error(w, "Failed to save user", http.StatusInternalServerError)
+			return
+		}
+		before := users[i].User
+		users[i] = user
+		if user.Disabled || req.Password != "" {
+			revokeUserSessions(user.ID, "")
+		}
+		recordAudit(r, "user.update", "user/"+user.Username, before, user.User)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user.User)
+		return
+	}
+
+	http.Error(w, "User not found", http.StatusNotFound)
+}
+
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	if current, _ := currentUser(r); current.ID == id {
+		http.Error(w, "Cannot delete the current user", http.StatusBadRequest)
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	for i := range users {
+		if users[i].ID != id {
+			continue
+		}
+		user := users[i]
+		if countAdmins(users, user.ID) == 0 {
+			http.Error(w, "Cannot delete the last admin", http.StatusBadRequest)
+			return
+		}
+		if err := os.Remove(userDataPath(user.Username)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Go] 删除用户文件失败: %v\n", err)
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+		users = append(users[:i], users[i+1:]...)
+		revokeUserSessions(user.ID, "")
+		revokeUserTokens(user.ID)
+		recordAudit(r, "user.delete", "user/"+user.Username, user.User, nil)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user.User)
+		return
+	}
+
+	http.Error(w, "User not found", http.StatusNotFound)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BLOB_DATA_DIR = "/blobs" // 二进制文件内容存储子目录, 按 SHA-256 寻址
+
+	maxUploadSize = 512 << 20 // 单个上传文件最大 512MB
+)
+
+// 运行时 playbook 可通过 files/<name> 引用文件管理中的文件 (copy:/unarchive: 的 src)
+const runFilesDir = "files"
+
+// blobMutex 保护内容存储: 去重与写入、引用检查与删除、运行时的链接不会交错;
+// 需要同时持有时先获取 filesMutex 再获取 blobMutex
+var (
+	blobMutex    sync.Mutex
+	pendingBlobs = map[string]int{} // 已写入但还没有登记到文件的内容和运行中链接的内容, 由 releaseBlob 释放
+)
+
+func blobPath(checksum string) string {
+	return filepath.Join(DATA_DIR, BLOB_DATA_DIR, checksum[:2], checksum)
+}
+
+// storeBlob 将内容写入内容寻址存储, 返回 SHA-256、大小和探测到的 MIME 类型;
+// 内容在调用方 releaseBlob 之前不会被删除
+func storeBlob(src io.Reader, filename string) (string, int64, string, error) {
+	dir := filepath.Join(DATA_DIR, BLOB_DATA_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", 0, "", err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".upload-*")
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	// 读取开头用于 MIME 探测, 之后与剩余内容一起流式写入
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		tmp.Close()
+		return "", 0, "", err
+	}
+	head = head[:n]
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.MultiReader(bytes.NewReader(head), src))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	target := blobPath(checksum)
+
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+
+	// 相同内容已存在时直接复用
+	if _, err := os.Stat(target); err != nil {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return "", 0, "", err
+		}
+		if err := os.Rename(tmp.Name(), target); err != nil {
+			return "", 0, "", err
+		}
+	}
+	pendingBlobs[checksum]++
+	return checksum, size, detectMimeType(head, filename), nil
+}
+
+// detectMimeType 优先根据内容探测, 无法识别时再根据扩展名判断
+func detectMimeType(head []byte, filename string) string {
+	detected := http.DetectContentType(head)
+	if detected != "application/octet-stream" && detected != "text/plain; charset=utf-8" {
+		return detected
+	}
+	if byExt := mime.TypeByExtension(filepath.Ext(filename)); byExt != "" {
+		return byExt
+	}
+	return detected
+}
+
+// releaseBlob 释放 storeBlob 或 stageRunFiles 保留的内容, 没有被文件引用时删除, 调用方需持有 filesMutex
+func releaseBlob(checksum string) {
+	blobMutex.Lock()
+	if pendingBlobs[checksum]--; pendingBlobs[checksum] <= 0 {
+		delete(pendingBlobs, checksum)
+	}
+	blobMutex.Unlock()
+	removeBlobIfUnused(checksum)
+}
+
+// removeBlobIfUnused 删除不再被任何文件引用的内容, 调用方需持有 filesMutex
+func removeBlobIfUnused(checksum string) {
+	if checksum == "" {
+		return
+	}
+
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+
+	if pendingBlobs[checksum] > 0 {
+		return
+	}
+	for _, file := range files {
+		if file.Blob && file.Checksum == checksum {
+			return
+		}
+	}
+	if err := os.Remove(blobPath(checksum)); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("[Go] 删除文件内容失败: %v\n", err)
+	}
+}
+
+// fillTextFileMeta 为 JSON 提交的文本文件计算大小和校验和
+func fillTextFileMeta(file *File) {
+	sum := sha256.Sum256([]byte(file.Content))
+	file.Blob = false
+	file.Size = int64(len(file.Content))
+	file.Checksum = hex.EncodeToString(sum[:])
+	file.MimeType = detectMimeType([]byte(file.Content), file.Name)
+}
+
+// uploadFileHandler 以 multipart/form-data 上传文件, 表单字段:
+//
+//	file        文件内容
+//	name        可选, 文件名, 默认使用上传的文件名
+//	type        可选, 文件类型
+//	description 可选, 描述
+//	id          可选, 替换已有文件的内容
+func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+(1<<20))
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// 逐个读取表单字段, 文件内容直接流式写入磁盘而不整体读入内存
+	var file File
+	var replaceID int
+	uploaded := false
+	// 结束时释放上传的内容, 没有登记成功时随之删除
+	defer func() {
+		if uploaded {
+			filesMutex.Lock()
+			releaseBlob(file.Checksum)
+			filesMutex.Unlock()
+		}
+	}()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() == "file" {
+			if uploaded {
+				part.Close()
+				http.Error(w, "Only one file can be uploaded", http.StatusBadRequest)
+				return
+			}
+			if file.Name == "" {
+				file.Name = filepath.Base(part.FileName())
+			}
+			limited := &io.LimitedReader{R: part, N: maxUploadSize + 1}
+			checksum, size, mimeType, err := storeBlob(limited, part.FileName())
+			part.Close()
+			if err != nil {
+				fmt.Printf("[Go] 保存上传文件失败: %v\n", err)
+				http.Error(w, "Failed to save uploaded file", http.StatusInternalServerError)
+				return
+			}
+			file.Blob = true
+			file.Checksum = checksum
+			file.Size = size
+			file.MimeType = mimeType
+			uploaded = true
+			if size > maxUploadSize {
+				http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			continue
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, 64<<10))
+		part.Close()
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		switch part.FormName() {
+		case "name":
+			file.Name = string(value)
+		case "type":
+			file.Type = string(value)
+		case "description":
+			file.Description = string(value)
+		case "id":
+			replaceID, _ = strconv.Atoi(string(value))
+		}
+	}
+
+	if !uploaded {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	if !namePattern.MatchString(file.Name) {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	index := -1
+	for i := range files {
+		if replaceID != 0 && files[i].ID == replaceID {
+			index = i
+		} else if files[i].Name == file.Name {
+			http.Error(w, "File name already exists", http.StatusConflict)
+			return
+		}
+	}
+	if replaceID != 0 && index == -1 {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	file.UpdatedAt = time.Now()
+	if index == -1 {
+		file.ID = fileID + 1
+		file.CreatedAt = file.UpdatedAt
+	} else {
+		file.ID = files[index].ID
+		file.CreatedAt = files[index].CreatedAt
+		if file.Type == "" {
+			file.Type = files[index].Type
+		}
+		if file.Description == "" {
+			file.Description = files[index].Description
+		}
+	}
+
+	if err := saveFileData(file); err != nil {
+		fmt.Printf("[Go] 保存文件数据失败: %v\n", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+
+	if index == -1 {
+		fileID++
+		files = append(files, file)
+		recordAudit(r, "file.upload", "file/"+file.Name, nil, file)
+	} else {
+		old := files[index]
+		files[index] = file
+		recordAudit(r, "file.upload", "file/"+file.Name, old, file)
+		if old.Name != file.Name {
+			if err := os.Remove(fileDataPath(old.Name)); err != nil && !os.IsNotExist(err) {
+				fmt.Printf("[Go] 删除旧文件数据失败: %v\n", err)
+			}
+		}
+		if old.Blob {
+			removeBlobIfUnused(old.Checksum)
+		}
+	}
+	fmt.Printf("[Go] 文件 %s 上传成功: %d 字节, sha256=%s\n", file.Name, file.Size, file.Checksum)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// downloadFileHandler 流式下载文件内容, 支持 Range 请求
+func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+
+	filesMutex.Lock()
+	var file File
+	found := false
+	for _, f := range files {
+		if f.ID == id {
+			file = f
+			found = true
+			break
+		}
+	}
+	filesMutex.Unlock()
+
+	if !found {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if file.MimeType != "" {
+		w.Header().Set("Content-Type", file.MimeType)
+	}
+	if file.Checksum != "" {
+		w.Header().Set("X-Checksum-Sha256", file.Checksum)
+		w.Header().Set("ETag", `"`+file.Checksum+`"`)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+
+	if !file.Blob {
+		http.ServeContent(w, r, file.Name, file.UpdatedAt, bytes.NewReader([]byte(file.Content)))
+		return
+	}
+
+	f, err := os.Open(blobPath(file.Checksum))
+	if err != nil {
+		fmt.Printf("[Go] 打开文件内容失败: %v\n", err)
+		http.Error(w, "File content missing", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, file.Name, file.UpdatedAt, f)
+}
+
+// runFileReferences 返回运行中可能引用文件名的内容: playbook、ad-hoc 参数和变量值
+func runFileReferences(req AnsibleRequest) string {
+	references := req.Playbook
+	if req.Adhoc != nil {
+		references += "\n" + req.Adhoc.Args
+	}
+	if data, err := json.Marshal(req.Variables); err == nil {
+		references += "\n" + string(data)
+	}
+	return references
+}
+
+// stageRunFiles 将 references 中出现了名称的文件放到运行目录的 files/ 下,
+// playbook 中的 copy:/unarchive: 可以直接用 src: <name> 引用; 链接的内容记录在 run.blobs 中,
+// 在 cleanup 之前不会因为删除或替换文件而被删除
+func stageRunFiles(run *preparedRun, references string) error {
+	dir := filepath.Join(run.Dir, runFilesDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+
+	for _, file := range files {
+		if !strings.Contains(references, file.Name) {
+			continue
+		}
+		target := filepath.Join(dir, file.Name)
+		if file.Blob {
+			// 二进制内容使用符号链接, 避免每次运行都复制大文件
+			source, err := filepath.Abs(blobPath(file.Checksum))
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(source, target); err != nil {
+				return err
+			}
+			pendingBlobs[file.Checksum]++
+			run.blobs = append(run.blobs, file.Checksum)
+			continue
+		}
+		if err := ioutil.WriteFile(target, []byte(file.Content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseRunFiles 释放运行期间保留的内容
+func releaseRunFiles(run *preparedRun) {
+	if len(run.blobs) == 0 {
+		return
+	}
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	for _, checksum := range run.blobs {
+		releaseBlob(checksum)
+	}
+	run.blobs = nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	configFileEnv     = "ANSIBLE_WEB_CONFIG" // 配置文件路径, 也可以用 -config 参数指定
+	defaultConfigFile = "./config.yaml"      // 默认配置文件, 不存在时只使用默认值
+	configEnvPrefix   = "ANSIBLE_WEB_"       // 环境变量覆盖配置项, 例如 ANSIBLE_WEB_LISTEN
+)
+
+// Duration 在配置文件和 /config 中使用 30s、12h 这样的格式
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON 接受 "30m" 这样的字符串, 空字符串表示 0
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30m\"")
+	}
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Config 是服务端配置, 优先级从低到高为: 默认值、配置文件、环境变量、命令行参数
+type Config struct {
+	Listen               string   `json:"listen"`
+	TemplatesDir         string   `json:"templates_dir"`
+	DataDir              string   `json:"data_dir"`
+	GalaxyDir            string   `json:"galaxy_dir"` // 角色与集合的安装目录
+	TempDir              string   `json:"temp_dir"`   // 运行使用的临时目录, 为空时使用系统默认
+	AnsiblePlaybook      string   `json:"ansible_playbook"`
+	Ansible              string   `json:"ansible"`
+	AllowedOrigins       []string `json:"allowed_origins"`
+	SessionTTL           Duration `json:"session_ttl"`
+	HealthCheckTimeout   Duration `json:"health_check_timeout"`
+	ReadHeaderTimeout    Duration `json:"read_header_timeout"`
+	ShutdownTimeout      Duration `json:"shutdown_timeout"`       // 关闭服务时等待运行结束的时间, 超过后取消
+	MaxConcurrentRuns    int      `json:"max_concurrent_runs"`    // 同时执行的运行数上限, 0 表示不限制
+	MaxRunsPerUser       int      `json:"max_runs_per_user"`      // 每个用户同时执行的运行数上限, 0 表示不限制
+	RunTimeout           Duration `json:"run_timeout"`            // 单次运行的最长时间, 0 表示不限制
+	RunInactivityTimeout Duration `json:"run_inactivity_timeout"` // 运行没有输出的最长时间, 0 表示不限制
+	AdhocAllowedModules  []string `json:"adhoc_allowed_modules"`  // /adhoc 允许的模块, 为空时允许所有未禁止的模块
+	AdhocDeniedModules   []string `json:"adhoc_denied_modules"`   // /adhoc 禁止的模块, 优先于允许列表
+	RunEnvAllowlist      []string `json:"run_env_allowlist"`      // 运行请求可以设置的环境变量, 支持 * 通配
+}
+
+var defaultConfig = Config{
+	Listen:              ":8080",
+	TemplatesDir:        "./templates",
+	DataDir:             "./data",
+	GalaxyDir:           "./galaxy",
+	AnsiblePlaybook:     "ansible-playbook",
+	Ansible:             "ansible",
+	AllowedOrigins:      []string{"http://localhost:3000", "http://127.0.0.1:3000"}, // 前端开发服务器
+	SessionTTL:          Duration(12 * time.Hour),
+	HealthCheckTimeout:  Duration(30 * time.Second),
+	ReadHeaderTimeout:   Duration(10 * time.Second),
+	ShutdownTimeout:     Duration(5 * time.Minute),
+	MaxConcurrentRuns:   10,
+	MaxRunsPerUser:      3,
+	RunTimeout:          Duration(time.Hour),
+	AdhocAllowedModules: []string{"ping", "setup", "command", "shell", "service", "systemd", "stat"},
+	AdhocDeniedModules:  []string{"raw", "script"},
+	RunEnvAllowlist: []string{
+		"ANSIBLE_HOST_KEY_CHECKING", "ANSIBLE_PIPELINING", "ANSIBLE_TIMEOUT", "ANSIBLE_FORCE_COLOR",
+		"ANSIBLE_DISPLAY_SKIPPED_HOSTS", "ANSIBLE_CALLBACKS_ENABLED", "ANSIBLE_STDOUT_CALLBACK",
+		"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	},
+}
+
+var (
+	serverConfig = defaultConfig
+	configFile   string            // 实际加载的配置文件, 没有时为空
+	configSource map[string]string // 每个配置项的来源: default, file, env 或 flag
+)
+
+// configSetting 描述一个配置项; 配置文件中使用 key, 环境变量为 ANSIBLE_WEB_ 加大写的 key,
+// 命令行参数为把 _ 换成 - 的 key
+type configSetting struct {
+	key   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var configSettings = []configSetting{
+	{"listen", "监听地址, 例如 :8080 或 127.0.0.1:8080", stringSetting(func(c *Config) *string { return &c.Listen })},
+	{"templates_dir", "模板文件存储目录", stringSetting(func(c *Config) *string { return &c.TemplatesDir })},
+	{"data_dir", "数据存储目录", stringSetting(func(c *Config) *string { return &c.DataDir })},
+	{"galaxy_dir", "角色与集合的安装目录", stringSetting(func(c *Config) *string { return &c.GalaxyDir })},
+	{"temp_dir", "运行使用的临时目录, 为空时使用系统默认", stringSetting(func(c *Config) *string { return &c.TempDir })},
+	{"ansible_playbook", "ansible-playbook 可执行文件", stringSetting(func(c *Config) *string { return &c.AnsiblePlaybook })},
+	{"ansible", "ansible 可执行文件, 用于主机健康检查和 ad-hoc 命令", stringSetting(func(c *Config) *string { return &c.Ansible })},
+	{"allowed_origins", "允许跨域访问的来源, 逗号分隔, * 表示任意来源", listSetting(func(c *Config) *[]string { return &c.AllowedOrigins })},
+	{"session_ttl", "登录会话有效期", durationSetting(func(c *Config) *Duration { return &c.SessionTTL })},
+	{"health_check_timeout", "单台主机健康检查超时", durationSetting(func(c *Config) *Duration { return &c.HealthCheckTimeout })},
+	{"read_header_timeout", "读取请求头超时", durationSetting(func(c *Config) *Duration { return &c.ReadHeaderTimeout })},
+	{"shutdown_timeout", "关闭服务时等待运行结束的时间", durationSetting(func(c *Config) *Duration { return &c.ShutdownTimeout })},
+	{"max_concurrent_runs", "同时执行的运行数上限, 0 表示不限制", intSetting(func(c *Config) *int { return &c.MaxConcurrentRuns })},
+	{"max_runs_per_user", "每个用户同时执行的运行数上限, 0 表示不限制", intSetting(func(c *Config) *int { return &c.MaxRunsPerUser })},
+	{"run_timeout", "单次运行的最长时间, 0 表示不限制", durationSetting(func(c *Config) *Duration { return &c.RunTimeout })},
+	{"run_inactivity_timeout", "运行没有输出的最长时间, 0 表示不限制", durationSetting(func(c *Config) *Duration { return &c.RunInactivityTimeout })},
+	{"adhoc_allowed_modules", "/adhoc 允许的模块 (逗号分隔), 为空时允许所有未禁止的模块", listSetting(func(c *Config) *[]string { return &c.AdhocAllowedModules })},
+	{"adhoc_denied_modules", "/adhoc 禁止的模块 (逗号分隔), 优先于允许列表", listSetting(func(c *Config) *[]string { return &c.AdhocDeniedModules })},
+	{"run_env_allowlist", "运行请求可以设置的环境变量 (逗号分隔), 支持 * 通配", listSetting(func(c *Config) *[]string { return &c.RunEnvAllowlist })},
+}
+
+func stringSetting(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func listSetting(field func(c *Config) *[]string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(c) = list
+		return nil
+	}
+}
+
+func intSetting(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func durationSetting(field func(c *Config) *Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*field(c) = Duration(d)
+		return nil
+	}
+}
+
+func findConfigSetting(key string) (configSetting, bool) {
+	for _, setting := range configSettings {
+		if setting.key == key {
+			return setting, true
+		}
+	}
+	return configSetting{}, false
+}
+
+// loadConfig 依次应用配置文件、环境变量和命令行参数, 并校验最终配置
+func loadConfig(args []string) error {
+	config := defaultConfig
+	sources := map[string]string{}
+	for _, setting := range configSettings {
+		sources[setting.key] = "default"
+	}
+
+	// 先解析命令行参数, 最后再应用, 保证其优先级最高
+	flags := flag.NewFlagSet("ansible-web", flag.ContinueOnError)
+	path := flags.String("config", "", "配置文件路径 (YAML)")
+	var flagValues [][2]string
+	for _, setting := range configSettings {
+		key := setting.key
+		flags.Func(strings.Replace(key, "_", "-", -1), setting.usage, func(value string) error {
+			flagValues = append(flagValues, [2]string{key, value})
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// 配置文件: -config 参数 > ANSIBLE_WEB_CONFIG > ./config.yaml (可选)
+	file, required := *path, true
+	if file == "" {
+		file = os.Getenv(configFileEnv)
+	}
+	if file == "" {
+		file, required = defaultConfigFile, false
+	}
+	values, err := readConfigFile(file)
+	if os.IsNotExist(err) && !required {
+		file = ""
+	} else if err != nil {
+		return err
+	}
+	for _, kv := range values {
+		setting, ok := findConfigSetting(kv[0])
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", file, kv[0])
+		}
+		if err := setting.set(&config, kv[1]); err != nil {
+			return fmt.Errorf("%s: %s: %v", file, kv[0], err)
+		}
+		sources[kv[0]] = "file"
+	}
+
+	for _, setting := range configSettings {
+		name := configEnvPrefix + strings.ToUpper(setting.key)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := setting.set(&config, value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			sources[setting.key] = "env"
+		}
+	}
+
+	for _, kv := range flagValues {
+		setting, _ := findConfigSetting(kv[0])
+		if err := setting.set(&config, kv[1]); err != nil {
+			return fmt.Errorf("-%s: %v", strings.Replace(kv[0], "_", "-", -1), err)
+		}
+		sources[kv[0]] = "flag"
+	}
+
+	if err := validateConfig(config); err != nil {
+		return err
+	}
+
+	serverConfig = config
+	configFile = file
+	configSource = sources
+	TEMPLATES_DIR = config.TemplatesDir
+	DATA_DIR = config.DataDir
+	GALAXY_DIR = config.GalaxyDir
+	return nil
+}
+
+// validateConfig 检查配置是否可用; 找不到 ansible 可执行文件只提示, 不阻止启动
+func validateConfig(c Config) error {
+	host, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return fmt.Errorf("listen: invalid address %q", c.Listen)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("listen: invalid port %q", port)
+	}
+	if host != "" && host != "localhost" && net.ParseIP(host) == nil {
+		return fmt.Errorf("listen: invalid host %q", host)
+	}
+
+	if c.MaxConcurrentRuns < 0 {
+		return fmt.Errorf("max_concurrent_runs must not be negative")
+	}
+	if c.MaxRunsPerUser < 0 {
+		return fmt.Errorf("max_runs_per_user must not be negative")
+	}
+	if c.RunTimeout < 0 {
+		return fmt.Errorf("run_timeout must not be negative")
+	}
+	if c.RunInactivityTimeout < 0 {
+		return fmt.Errorf("run_inactivity_timeout must not be negative")
+	}
+	for _, pattern := range c.RunEnvAllowlist {
+		if _, err := path.Match(pattern, ""); err != nil || strings.HasPrefix(pattern, configEnvPrefix) {
+			return fmt.Errorf("run_env_allowlist: invalid pattern %q", pattern)
+		}
+	}
+
+	if c.TemplatesDir == "" {
+		return fmt.Errorf("templates_dir must not be empty")
+	}
+	if c.DataDir == "" {
+		return fmt.Errorf("data_dir must not be empty")
+	}
+	if c.GalaxyDir == "" {
+		return fmt.Errorf("galaxy_dir must not be empty")
+	}
+	if c.TempDir != "" {
+		info, err := os.Stat(c.TempDir)
+		if err != nil {
+			return fmt.Errorf("temp_dir: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("temp_dir: %s is not a directory", c.TempDir)
+		}
+	}
+
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimRight(u.Path, "/") != "" {
+			return fmt.Errorf("allowed_origins: invalid origin %q", origin)
+		}
+	}
+
+	for key, d := range map[string]Duration{
+		"session_ttl":          c.SessionTTL,
+		"health_check_timeout": c.HealthCheckTimeout,
+		"read_header_timeout":  c.ReadHeaderTimeout,
+		"shutdown_timeout":     c.ShutdownTimeout,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive", key)
+		}
+	}
+
+	for key, binary := range map[string]string{"ansible_playbook": c.AnsiblePlaybook, "ansible": c.Ansible} {
+		if binary == "" {
+			return fmt.Errorf("%s must not be empty", key)
+		}
+		if _, err := exec.LookPath(binary); err != nil {
+			fmt.Printf("[Go] 警告: 找不到 %s (%s): %v\n", key, binary, err)
+		}
+	}
+	return nil
+}
+
+// readConfigFile 读取配置文件, 支持 YAML 的一个子集: 顶层的 key: value,
+// 引号字符串, # 注释, 以及 [a, b] 或 "- item" 形式的列表 (按逗号拼接后交给 listSetting)
+func readConfigFile(path string) ([][2]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values [][2]string
+	seen := map[string]bool{}
+	var listKey string // 正在读取 "- item" 列表的配置项
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if listKey == "" || line == trimmed {
+				return nil, fmt.Errorf("%s:%d: unexpected list item", path, lineNo)
+			}
+			item, err := parseConfigScalar(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+			last := &values[len(values)-1]
+			if last[1] != "" {
+				last[1] += ","
+			}
+			last[1] += item
+			continue
+		}
+		listKey = ""
+
+		if line != trimmed {
+			return nil, fmt.Errorf("%s:%d: nested values are not supported", path, lineNo)
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, lineNo)
+		}
+		key := strings.TrimSpace(line[:colon])
+		if seen[key] {
+			return nil, fmt.Errorf("%s:%d: duplicate key %q", path, lineNo, key)
+		}
+		seen[key] = true
+
+		raw := strings.TrimSpace(line[colon+1:])
+		var value string
+		switch {
+		case raw == "" || strings.HasPrefix(raw, "#"):
+			listKey = key
+		case strings.HasPrefix(raw, "["):
+			end := strings.LastIndex(raw, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("%s:%d: unterminated list", path, lineNo)
+			}
+			var items []string
+			for _, item := range strings.Split(raw[1:end], ",") {
+				if item = strings.TrimSpace(item); item == "" {
+					continue
+				}
+				item, err := parseConfigScalar(item)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+				}
+				items = append(items, item)
+			}
+			value = strings.Join(items, ",")
+		default:
+			if value, err = parseConfigScalar(raw); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+		}
+		values = append(values, [2]string{key, value})
+	}
+	return values, scanner.Err()
+}
+
+// parseConfigScalar 去掉引号或行尾注释
+func parseConfigScalar(raw string) (string, error) {
+	if strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'") {
+		quote := raw[:1]
+		end := strings.Index(raw[1:], quote)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string %s", raw)
+		}
+		rest := strings.TrimSpace(raw[end+2:])
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected text after string: %s", rest)
+		}
+		if quote == `"` {
+			return strconv.Unquote(raw[:end+2])
+		}
+		return raw[1 : end+1], nil
+	}
+	if i := strings.Index(raw, " #"); i >= 0 {
+		raw = raw[:i]
+	}
+	return strings.TrimSpace(raw), nil
+}
+
+// getConfigHandler 返回当前生效的配置以及每项的来源, 配置中不包含机密
+func getConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		File    string            `json:"file,omitempty"`
+		Config  Config            `json:"config"`
+		Sources map[string]string `json:"sources"`
+	}{configFile, serverConfig, configSource})
+}
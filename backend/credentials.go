@@ -0,0 +1,710 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CREDENTIAL_DATA_DIR = "/credentials" // 加密后的连接凭据子目录
+
+	runKeysDir = "keys" // 运行目录中存放私钥的子目录
+)
+
+// 支持的 become 方式
+var becomeMethods = map[string]bool{
+	"": true, "sudo": true, "su": true, "pbrun": true, "pfexec": true, "doas": true,
+	"dzdo": true, "ksu": true, "runas": true, "machinectl": true, "sesu": true,
+}
+
+// Credential 是主机的连接凭据, 对外不返回任何机密字段
+type Credential struct {
+	ID                int       `json:"id"`
+	Name              string    `json:"name"`
+	Description       string    `json:"description"`
+	Username          string    `json:"username"`
+	BecomeMethod      string    `json:"become_method"`
+	BecomeUser        string    `json:"become_user"`
+	Groups            []string  `json:"groups"` // 应用此凭据的主机组
+	HasPassword       bool      `json:"has_password"`
+	HasPrivateKey     bool      `json:"has_private_key"`
+	HasPassphrase     bool      `json:"has_passphrase"`
+	HasBecomePassword bool      `json:"has_become_password"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// storedCredential 是持久化到磁盘的凭据, 机密字段使用主密钥加密
+type storedCredential struct {
+	Credential
+	Password       string `json:"password,omitempty"`
+	PrivateKey     string `json:"private_key,omitempty"`
+	Passphrase     string `json:"passphrase,omitempty"`
+	BecomePassword string `json:"become_password,omitempty"`
+}
+
+// CredentialRequest 是新增和更新凭据的请求体, 机密字段为空表示保持不变
+type CredentialRequest struct {
+	ID             int      `json:"id"`
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Username       string   `json:"username"`
+	BecomeMethod   string   `json:"become_method"`
+	BecomeUser     string   `json:"become_user"`
+	Groups         []string `json:"groups"`
+	Password       string   `json:"password"`
+	PrivateKey     string   `json:"private_key"`
+	Passphrase     string   `json:"passphrase"`
+	BecomePassword string   `json:"become_password"`
+	Clear          []string `json:"clear"` // 需要清除的机密字段, 如 ["password"]
+}
+
+// credentialSecrets 是解密后的凭据, 只在运行时使用
+type credentialSecrets struct {
+	Credential
+	Password       string
+	PrivateKey     string
+	Passphrase     string
+	BecomePassword string
+}
+
+var (
+	credentials      []storedCredential
+	credentialID     int
+	credentialsMutex sync.Mutex
+)
+
+func credentialDataPath(name string) string {
+	return filepath.Join(DATA_DIR, CREDENTIAL_DATA_DIR, name+".json")
+}
+
+func saveCredentialFile(credential storedCredential) error {
+	data, err := json.MarshalIndent(credential, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := credentialDataPath(credential.Name)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 从文件系统加载凭据
+func loadCredentialsFromFiles() error {
+	credentials = []storedCredential{}
+
+	dir := filepath.Join(DATA_DIR, CREDENTIAL_DATA_DIR)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var credential storedCredential
+		if err := json.Unmarshal(data, &credential); err != nil {
+			fmt.Printf("[Go] 跳过无效的凭据文件 %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if credential.ID > credentialID {
+			credentialID = credential.ID
+		}
+		credentials = append(credentials, credential)
+	}
+
+	return nil
+}
+
+// credentialField 返回加密凭据字段时使用的附加数据, 绑定凭据名与字段名
+func credentialField(name, field string) string {
+	return "credential/" + name + "/" + field
+}
+
+// applyCredentialRequest 将请求中的字段写入凭据, 机密字段加密保存
+func applyCredentialRequest(credential *storedCredential, req CredentialRequest) error {
+	credential.Description = req.Description
+	credential.Username = req.Username
+	credential.BecomeMethod = req.BecomeMethod
+	credential.BecomeUser = req.BecomeUser
+	credential.Groups = req.Groups
+
+	fields := []struct {
+		name   string
+		value  string
+		target *string
+	}{
+		{"password", req.Password, &credential.Password},
+		{"private_key", req.PrivateKey, &credential.PrivateKey},
+		{"passphrase", req.Passphrase, &credential.Passphrase},
+		{"become_password", req.BecomePassword, &credential.BecomePassword},
+	}
+	for _, field := range fields {
+		for _, clear := range req.Clear {
+			if clear == field.name {
+				*field.target = ""
+			}
+		}
+		if field.value == "" {
+			continue
+		}
+		ciphertext, err := encryptSecretValue(credentialField(credential.Name, field.name), field.value)
+		if err != nil {
+			return err
+		}
+		*field.target = ciphertext
+	}
+
+	credential.HasPassword = credential.Password != ""
+	credential.HasPrivateKey = credential.PrivateKey != ""
+	credential.HasPassphrase = credential.Passphrase != ""
+	credential.HasBecomePassword = credential.BecomePassword != ""
+	return nil
+}
+
+func validateCredentialRequest(req CredentialRequest) error {
+	if !namePattern.MatchString(req.Name) {
+		return fmt.Errorf("Invalid credential name")
+	}
+	if !becomeMethods[req.BecomeMethod] {
+		return fmt.Errorf("Unsupported become method: %s", req.BecomeMethod)
+	}
+	if req.PrivateKey != "" && !strings.Contains(req.PrivateKey, "PRIVATE KEY-----") {
+		return fmt.Errorf("Private key must be in PEM or OpenSSH format")
+	}
+	for _, group := range req.Groups {
+		if !namePattern.MatchString(group) {
+			return fmt.Errorf("Invalid group name: %s", group)
+		}
+	}
+	return nil
+}
+
+// checkCredentialGroups 检查主机组没有分配给其他凭据, 否则运行时使用哪个凭据不确定;
+// id 为正在更新的凭据, 新增时为 0。调用方需持有 credentialsMutex
+func checkCredentialGroups(id int, groups []string) error {
+	for _, existing := range credentials {
+		if existing.ID == id {
+			continue
+		}
+		for _, group := range groups {
+			for _, assigned := range existing.Groups {
+				if group == assigned {
+					return fmt.Errorf("Group %s is already assigned to credential %s", group, existing.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decryptCredential 解密凭据中的机密字段, 调用方需持有 credentialsMutex
+func decryptCredential(credential storedCredential) (credentialSecrets, error) {
+	result := credentialSecrets{Credential: credential.Credential}
+	fields := []struct {
+		name       string
+		ciphertext string
+		target     *string
+	}{
+		{"password", credential.Password, &result.Password},
+		{"private_key", credential.PrivateKey, &result.PrivateKey},
+		{"passphrase", credential.Passphrase, &result.Passphrase},
+		{"become_password", credential.BecomePassword, &result.BecomePassword},
+	}
+	for _, field := range fields {
+		if field.ciphertext == "" {
+			continue
+		}
+		value, err := decryptSecretValue(credentialField(credential.Name, field.name), field.ciphertext)
+		if err != nil {
+			return credentialSecrets{}, err
+		}
+		*field.target = value
+	}
+	return result, nil
+}
+
+// writeRunKey 将私钥以 0600 权限写入运行目录; 有密码短语时借助 ssh-keygen 去除,
+// 密码短语通过 SSH_ASKPASS 传入, 不会出现在进程参数中
+func writeRunKey(tmpDir string, credential credentialSecrets) (string, error) {
+	dir := filepath.Join(tmpDir, runKeysDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	keyFile := filepath.Join(dir, fmt.Sprintf("credential-%d", credential.ID))
+	if _, err := os.Stat(keyFile); err == nil {
+		return keyFile, nil
+	}
+
+	key := credential.PrivateKey
+	if !strings.HasSuffix(key, "\n") {
+		key += "\n"
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(key), 0600); err != nil {
+		return "", err
+	}
+	if credential.Passphrase == "" {
+		return keyFile, nil
+	}
+
+	passFile := keyFile + ".pass"
+	askpass := keyFile + ".askpass"
+	defer wipeFile(passFile)
+	defer os.Remove(askpass)
+	if err := ioutil.WriteFile(passFile, []byte(credential.Passphrase), 0600); err != nil {
+		return "", err
+	}
+	script := fmt.Sprintf("#!/bin/sh\ncat '%s'\n", passFile)
+	if err := ioutil.WriteFile(askpass, []byte(script), 0700); err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("ssh-keygen", "-p", "-q", "-N", "", "-f", keyFile)
+	cmd.Env = append(os.Environ(), "SSH_ASKPASS="+askpass, "SSH_ASKPASS_REQUIRE=force", "DISPLAY=:0")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to unlock private key of credential %s: %v: %s", credential.Name, err, strings.TrimSpace(string(output)))
+	}
+	return keyFile, nil
+}
+
+// credentialVars 生成写入 host_vars/group_vars 的连接变量
+func credentialVars(tmpDir string, credential credentialSecrets) (map[string]string, error) {
+	vars := map[string]string{}
+	if credential.Username != "" {
+		vars["ansible_user"] = credential.Username
+	}
+	if credential.Password != "" {
+		vars["ansible_password"] = credential.Password
+	}
+	if credential.PrivateKey != "" {
+		keyFile, err := writeRunKey(tmpDir, credential)
+		if err != nil {
+			return nil, err
+		}
+		vars["ansible_ssh_private_key_file"] = keyFile
+	}
+	if credential.BecomeMethod != "" {
+		vars["ansible_become_method"] = credential.BecomeMethod
+	}
+	if credential.BecomeUser != "" {
+		vars["ansible_become_user"] = credential.BecomeUser
+	}
+	if credential.BecomePassword != "" {
+		vars["ansible_become_password"] = credential.BecomePassword
+	}
+	return vars, nil
+}
+
+// connectionVarPrefixes 是改变连接目标或 ssh/scp/sftp 参数的变量, 下发已保存的凭据时不允许通过请求变量
+// 或请求中的 inventory 设置, 否则可以把凭据发往其他地址; 限定 inventory 或主机组的运行权限也不能设置
+var connectionVarPrefixes = []string{
+	"ansible_host", "ansible_ssh_host", "ansible_port", "ansible_connection",
+	"ansible_ssh_", "ansible_scp_", "ansible_sftp_", "ansible_paramiko_",
+}
+
+func isConnectionVar(name string) bool {
+	for _, prefix := range connectionVarPrefixes {
+		if name == prefix || strings.HasSuffix(prefix, "_") && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareRunCredentials 将主机和主机组的凭据写入运行目录:
+// 私钥写入 keys/ (0600), 连接变量以 vault 加密写入 host_vars/ 和 group_vars/,
+// ansible 会自动加载 inventory 旁边的这些目录。返回需要追加的参数
+//
+// 只有服务端确定的主机和主机组才会得到凭据:
+//   - 使用 inventory 模板时, 凭据的 groups 只写入模板中出现的主机组, credential_id 指定的凭据应用于 all 组,
+//     并通过 --private-key/-u 传入
+//   - 使用请求中的 inventory 时, 主机组和主机地址都由请求方决定, 因此只为 inventory 中出现的已登记主机写入
+//     host_vars, 凭据按主机自身或其登记的主机组确定, 并把 ansible_host 固定为登记的地址;
+//     此时 inventory 中不能设置任何连接变量
+func prepareRunCredentials(tmpDir string, req AnsibleRequest) ([]string, error) {
+	templateInventory := req.InventoryTemplate != ""
+	inventoryHostnames := map[string]bool{}
+	for _, hostname := range inventoryHosts(req.Inventory) {
+		inventoryHostnames[hostname] = true
+	}
+
+	hostsMutex.Lock()
+	registered := map[string]Host{}
+	for _, host := range hosts {
+		if namePattern.MatchString(host.Hostname) && inventoryHostnames[host.Hostname] {
+			registered[host.Hostname] = host
+		}
+	}
+	hostsMutex.Unlock()
+
+	// 新增和更新时不允许两个凭据使用同一主机组; 已保存的重复分配按凭据顺序取第一个
+	credentialsMutex.Lock()
+	decrypted := map[int]credentialSecrets{}
+	groupCredentials := map[string]int{}
+	for _, credential := range credentials {
+		plain, err := decryptCredential(credential)
+		if err != nil {
+			credentialsMutex.Unlock()
+			return nil, err
+		}
+		decrypted[credential.ID] = plain
+		for _, group := range credential.Groups {
+			if _, ok := groupCredentials[group]; !ok {
+				groupCredentials[group] = credential.ID
+			}
+		}
+	}
+	credentialsMutex.Unlock()
+
+	var args []string
+	groupVars := map[string]int{}
+	hostVars := map[string]int{}
+	if templateInventory {
+		for _, group := range append(inventoryGroups(req.Inventory), "all") {
+			if id, ok := groupCredentials[group]; ok {
+				groupVars[group] = id
+			}
+		}
+		for hostname, host := range registered {
+			if host.CredentialID != 0 {
+				hostVars[hostname] = host.CredentialID
+			}
+		}
+	} else {
+		for hostname, host := range registered {
+			group := host.Group
+			if group == "" {
+				group = "ungrouped"
+			}
+			if id := host.CredentialID; id != 0 {
+				hostVars[hostname] = id
+			} else if id, ok := groupCredentials[group]; ok {
+				hostVars[hostname] = id
+			} else if id, ok := groupCredentials["all"]; ok {
+				hostVars[hostname] = id
+			}
+		}
+	}
+	if req.CredentialID != 0 {
+		credential, ok := decrypted[req.CredentialID]
+		if !ok {
+			return nil, fmt.Errorf("credential %d not found", req.CredentialID)
+		}
+		// 运行级凭据覆盖 all 组上的凭据
+		groupVars["all"] = req.CredentialID
+		if credential.PrivateKey != "" {
+			keyFile, err := writeRunKey(tmpDir, credential)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "--private-key", keyFile)
+		}
+		if credential.Username != "" {
+			args = append(args, "-u", credential.Username)
+		}
+	}
+
+	if len(groupVars) > 0 || len(hostVars) > 0 {
+		for name := range req.Variables {
+			if isConnectionVar(name) {
+				return nil, fmt.Errorf("variable %s cannot be set when stored credentials are used", name)
+			}
+		}
+		if !templateInventory {
+			for _, name := range inventoryVarNames(req.Inventory) {
+				if isConnectionVar(name) {
+					return nil, fmt.Errorf("inventory variable %s cannot be set when stored credentials are used", name)
+				}
+			}
+		}
+	}
+
+	for group, id := range groupVars {
+		credential, ok := decrypted[id]
+		if !ok {
+			continue
+		}
+		vars, err := credentialVars(tmpDir, credential)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeVaultFile(tmpDir, filepath.Join(tmpDir, "group_vars", group+".yml"), vars); err != nil {
+			return nil, err
+		}
+	}
+	for hostname, id := range hostVars {
+		credential, ok := decrypted[id]
+		if !ok {
+			fmt.Printf("[Go] 主机 %s 引用的凭据 #%d 不存在\n", hostname, id)
+			continue
+		}
+		vars, err := credentialVars(tmpDir, credential)
+		if err != nil {
+			return nil, err
+		}
+		if !templateInventory {
+			// host_vars 的优先级高于 inventory 中的主机变量
+			address := registered[hostname].IP
+			if address == "" {
+				address = hostname
+			}
+			vars["ansible_host"] = address
+		}
+		if err := writeVaultFile(tmpDir, filepath.Join(tmpDir, "host_vars", hostname+".yml"), vars); err != nil {
+			return nil, err
+		}
+	}
+
+	return args, nil
+}
+
+// wipeFile 用零覆盖文件内容后删除, 避免机密残留在磁盘上
+func wipeFile(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if f, err := os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+		f.Write(make([]byte, info.Size()))
+		f.Sync()
+		f.Close()
+	}
+	os.Remove(path)
+}
+
+// wipeRunCredentials 在删除运行目录前擦除私钥和 vault 密码
+func wipeRunCredentials(tmpDir string) {
+	keys, _ := filepath.Glob(filepath.Join(tmpDir, runKeysDir, "*"))
+	for _, key := range keys {
+		wipeFile(key)
+	}
+	wipeFile(filepath.Join(tmpDir, runVaultPasswordFile))
+}
+
+func getCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+
+	list := make([]Credential, 0, len(credentials))
+	for _, credential := range credentials {
+		list = append(list, credential.Credential)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func addCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	var req CredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := validateCredentialRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+
+	for _, existing := range credentials {
+		if existing.Name == req.Name {
+			http.Error(w, "Credential name already exists", http.StatusConflict)
+			return
+		}
+	}
+	if err := checkCredentialGroups(0, req.Groups); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	credential := storedCredential{Credential: Credential{
+		ID:        credentialID + 1,
+		Name:      req.Name,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}}
+	if err := applyCredentialRequest(&credential, req); err != nil {
+		fmt.Printf("[Go] 加密凭据失败: %v\n", err)
+		http.Error(w, "Failed to encrypt credential", http.StatusInternalServerError)
+		return
+	}
+	if err := saveCredentialFile(credential); err != nil {
+		fmt.Printf("[Go] 保存凭据文件失败: %v\n", err)
+		http.Error(w, "Failed to save credential", http.StatusInternalServerError)
+		return
+	}
+	credentialID++
+	credentials = append(credentials, credential)
+	recordAudit(r, "credential.add", "credential/"+credential.Name, nil, credential)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(credential.Credential)
+}
+
+// updateCredentialHandler 更新凭据, 机密字段为空时保持不变; 不支持重命名
+func updateCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	var req CredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+
+	for i := range credentials {
+		if credentials[i].ID != req.ID {
+			continue
+		}
+		credential := credentials[i]
+		req.Name = credential.Name
+		if err := validateCredentialRequest(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkCredentialGroups(credential.ID, req.Groups); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err := applyCredentialRequest(&credential, req); err != nil {
+			fmt.Printf("[Go] 加密凭据失败: %v\n", err)
+			http.Error(w, "Failed to encrypt credential", http.StatusInternalServerError)
+			return
+		}
+		credential.UpdatedAt = time.Now()
+		if err := saveCredentialFile(credential); err != nil {
+			fmt.Printf("[Go] 保存凭据文件失败: %v\n", err)
+			http.Error(w, "Failed to save credential", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "credential.update", "credential/"+credential.Name, credentials[i], credential)
+		credentials[i] = credential
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(credential.Credential)
+		return
+	}
+
+	http.Error(w, "Credential not found", http.StatusNotFound)
+}
+
+func deleteCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+
+	for i := range credentials {
+		if credentials[i].ID != id {
+			continue
+		}
+		credential := credentials[i]
+		if err := os.Remove(credentialDataPath(credential.Name)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Go] 删除凭据文件失败: %v\n", err)
+			http.Error(w, "Failed to delete credential", http.StatusInternalServerError)
+			return
+		}
+		credentials = append(credentials[:i], credentials[i+1:]...)
+		recordAudit(r, "credential.delete", "credential/"+credential.Name, credential, nil)
+
+		// 解除主机上的引用
+		hostsMutex.Lock()
+		for j := range hosts {
+			if hosts[j].CredentialID == id {
+				hosts[j].CredentialID = 0
+			}
+		}
+		hostsMutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(credential.Credential)
+		return
+	}
+
+	http.Error(w, "Credential not found", http.StatusNotFound)
+}
+
+// assignHostCredentialHandler 为主机指定凭据, credential_id 为 0 表示取消
+func assignHostCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		HostID       int `json:"host_id"`
+		CredentialID int `json:"credential_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	// 在持有 hostsMutex 前取凭据名称, 删除凭据时按 credentialsMutex、hostsMutex 的顺序加锁
+	name := credentialName(req.CredentialID)
+	if req.CredentialID != 0 && name == "" {
+		http.Error(w, "Credential not found", http.StatusNotFound)
+		return
+	}
+
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+
+	for i := range hosts {
+		if hosts[i].ID == req.HostID {
+			if !authorize(w, r, ActionManageHosts, hostGroupScope(hosts[i])) {
+				return
+			}
+			if req.CredentialID != 0 && !authorize(w, r, ActionUseCredential, hostCredentialScope(hosts[i], name)) {
+				return
+			}
+			before := hosts[i]
+			hosts[i].CredentialID = req.CredentialID
+			recordAudit(r, "host.credential", fmt.Sprintf("host/%d", hosts[i].ID), before, hosts[i])
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(hosts[i])
+			return
+		}
+	}
+
+	http.Error(w, "Host not found", http.StatusNotFound)
+}
+
+// hostCredentialScope 返回为主机指定凭据的 use_credential 权限范围
+func hostCredentialScope(host Host, credential string) PermissionScope {
+	scope := hostGroupScope(host)
+	scope.Credential = credential
+	return scope
+}
+
+// credentialName 返回凭据名称, 用于 use_credential 权限的范围
+func credentialName(id int) string {
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+
+	for _, credential := range credentials {
+		if credential.ID == id {
+			return credential.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ENVIRONMENT_DATA_DIR = "/environments" // 执行环境数据子目录
+
+	environmentProbeTimeout = 30 * time.Second
+)
+
+// ExecutionEnvironment 是一套 ansible 可执行文件及其运行环境, 例如某个 virtualenv 中安装的 ansible-core;
+// 模板或运行请求按名称选择, 未选择时使用配置中的 ansible_playbook / ansible
+type ExecutionEnvironment struct {
+	ID              int               `json:"id"`
+	Name            string            `json:"name"`
+	Description     string            `json:"description"`
+	AnsiblePlaybook string            `json:"ansible_playbook,omitempty"` // ansible-playbook 的绝对路径, 为空时使用 venv/bin/ansible-playbook
+	Ansible         string            `json:"ansible,omitempty"`          // ansible 的绝对路径, 为空时使用 ansible-playbook 所在目录中的 ansible
+	Venv            string            `json:"venv,omitempty"`             // virtualenv 目录, 运行时设置 VIRTUAL_ENV 并将 bin 放到 PATH 最前面
+	Env             map[string]string `json:"env,omitempty"`              // 额外的环境变量
+	AnsibleConfig   string            `json:"ansible_config,omitempty"`   // ansible.cfg 的绝对路径, 通过 ANSIBLE_CONFIG 传递
+	Version         string            `json:"version,omitempty"`          // ansible --version 的第一行, 例如 ansible [core 2.15.3]
+	PythonVersion   string            `json:"python_version,omitempty"`
+	ProbeError      string            `json:"probe_error,omitempty"` // 最近一次版本探测失败的原因
+	ProbedAt        time.Time         `json:"probed_at"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+}
+
+// RunEnvironment 记录任务运行时使用的执行环境、ansible.cfg 和环境变量, 用于重现运行
+type RunEnvironment struct {
+	ExecutionEnvironment string            `json:"execution_environment,omitempty"` // 为空表示默认环境
+	AnsibleVersion       string            `json:"ansible_version,omitempty"`       // 运行时执行环境的版本探测结果
+	AnsibleConfig        string            `json:"ansible_cfg,omitempty"`           // 写入运行目录的 ansible.cfg 内容, 已脱敏
+	Env                  map[string]string `json:"env,omitempty"`                   // 运行请求设置的环境变量, 值已脱敏
+}
+
+var (
+	environments      []ExecutionEnvironment
+	environmentID     int
+	environmentsMutex sync.Mutex
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func environmentDataPath(id int) string {
+	return filepath.Join(DATA_DIR, ENVIRONMENT_DATA_DIR, fmt.Sprintf("%d.json", id))
+}
+
+func saveEnvironment(environment ExecutionEnvironment) error {
+	return writeJSONFile(environmentDataPath(environment.ID), environment)
+}
+
+// loadEnvironmentsFromFiles 加载执行环境, 并在后台重新探测版本
+func loadEnvironmentsFromFiles() error {
+	environments = []ExecutionEnvironment{}
+
+	dir := filepath.Join(DATA_DIR, ENVIRONMENT_DATA_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var environment ExecutionEnvironment
+		if err := json.Unmarshal(data, &environment); err != nil {
+			fmt.Printf("[Go] 跳过无效的执行环境文件 %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if environment.ID > environmentID {
+			environmentID = environment.ID
+		}
+		environments = append(environments, environment)
+	}
+
+	for _, environment := range environments {
+		go refreshEnvironmentProbe(environment.ID)
+	}
+	return nil
+}
+
+// validate 检查执行环境, 路径必须是绝对路径, 不在 PATH 中查找
+func (e ExecutionEnvironment) validate() error {
+	if !namePattern.MatchString(e.Name) {
+		return fmt.Errorf("invalid execution environment name %q", e.Name)
+	}
+	if e.AnsiblePlaybook == "" && e.Venv == "" {
+		return fmt.Errorf("ansible_playbook or venv is required")
+	}
+	for key, path := range map[string]string{
+		"ansible_playbook": e.AnsiblePlaybook,
+		"ansible":          e.Ansible,
+		"venv":             e.Venv,
+		"ansible_config":   e.AnsibleConfig,
+	} {
+		if path != "" && !filepath.IsAbs(path) {
+			return fmt.Errorf("%s must be an absolute path", key)
+		}
+	}
+	for name := range e.Env {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+	return nil
+}
+
+// binaries 返回执行环境中的 ansible-playbook 和 ansible
+func (e ExecutionEnvironment) binaries() (string, string) {
+	playbook := e.AnsiblePlaybook
+	if playbook == "" {
+		playbook = filepath.Join(e.Venv, "bin", "ansible-playbook")
+	}
+	ansible := e.Ansible
+	if ansible == "" {
+		if e.Venv != "" && e.AnsiblePlaybook == "" {
+			ansible = filepath.Join(e.Venv, "bin", "ansible")
+		} else {
+			ansible = filepath.Join(filepath.Dir(playbook), "ansible")
+		}
+	}
+	return playbook, ansible
+}
+
+// env 返回追加到进程环境变量之后的设置, 后出现的同名变量生效
+func (e ExecutionEnvironment) env() []string {
+	var env []string
+	if e.Venv != "" {
+		env = append(env,
+			"VIRTUAL_ENV="+e.Venv,
+			"PATH="+filepath.Join(e.Venv, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"),
+		)
+	}
+	if e.AnsibleConfig != "" {
+		env = append(env, "ANSIBLE_CONFIG="+e.AnsibleConfig)
+	}
+	for name, value := range e.Env {
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+// probe 执行 ansible --version, 记录 ansible 和 Python 的版本
+func (e *ExecutionEnvironment) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), environmentProbeTimeout)
+	defer cancel()
+
+	_, ansible := e.binaries()
+	cmd := exec.CommandContext(ctx, ansible, "--version")
+	cmd.Env = append(serverEnv(), e.env()...)
+	output, err := cmd.CombinedOutput()
+
+	e.ProbedAt = time.Now()
+	e.Version, e.PythonVersion, e.ProbeError = "", "", ""
+	if err != nil {
+		e.ProbeError = err.Error()
+		if text := strings.TrimSpace(string(output)); text != "" {
+			e.ProbeError += ": " + text
+		}
+		return
+	}
+	for i, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if i == 0 {
+			e.Version = line
+		}
+		if strings.HasPrefix(line, "python version = ") {
+			e.PythonVersion = strings.TrimPrefix(line, "python version = ")
+			if j := strings.Index(e.PythonVersion, " "); j >= 0 {
+				e.PythonVersion = e.PythonVersion[:j]
+			}
+		}
+	}
+}
+
+// refreshEnvironmentProbe 重新探测执行环境的版本并保存; 探测期间环境被修改或删除时放弃结果
+func refreshEnvironmentProbe(id int) (ExecutionEnvironment, bool) {
+	environment, ok := findEnvironmentByID(id)
+	if !ok {
+		return environment, false
+	}
+	probed := environment
+	probed.probe()
+
+	environmentsMutex.Lock()
+	defer environmentsMutex.Unlock()
+	for i := range environments {
+		if environments[i].ID != id {
+			continue
+		}
+		if !environments[i].UpdatedAt.Equal(environment.UpdatedAt) {
+			return environments[i], true
+		}
+		environments[i] = probed
+		if err := saveEnvironment(probed); err != nil {
+			fmt.Printf("[Go] 保存执行环境失败: %v\n", err)
+		}
+		return probed, true
+	}
+	return environment, false
+}
+
+func findEnvironmentByID(id int) (ExecutionEnvironment, bool) {
+	environmentsMutex.Lock()
+	defer environmentsMutex.Unlock()
+	for _, environment := range environments {
+		if environment.ID == id {
+			return environment, true
+		}
+	}
+	return ExecutionEnvironment{}, false
+}
+
+func findEnvironment(name string) (ExecutionEnvironment, bool) {
+	environmentsMutex.Lock()
+	defer environmentsMutex.Unlock()
+	for _, environment := range environments {
+		if environment.Name == name {
+			return environment, true
+		}
+	}
+	return ExecutionEnvironment{}, false
+}
+
+// runEnvironment 返回运行使用的执行环境: 请求中指定的优先, 其次是 playbook 模板的设置;
+// 都未设置时返回 nil, 使用配置中的可执行文件
+func runEnvironment(req AnsibleRequest) (*ExecutionEnvironment, error) {
+	name := req.ExecutionEnvironment
+	if name == "" && req.PlaybookTemplate != "" && req.Adhoc == nil {
+		if template, ok := findTemplate("playbook", req.PlaybookTemplate); ok {
+			name = template.ExecutionEnvironment
+		}
+	}
+	if name == "" {
+		return nil, nil
+	}
+	environment, ok := findEnvironment(name)
+	if !ok {
+		return nil, fmt.Errorf("execution environment %q not found", name)
+	}
+	return &environment, nil
+}
+
+// environmentUsers 返回引用执行环境的 playbook 模板
+func environmentUsers(name string) []string {
+	templatesMutex.Lock()
+	defer templatesMutex.Unlock()
+	var users []string
+	for _, template := range templates {
+		if template.ExecutionEnvironment == name {
+			users = append(users, template.Name)
+		}
+	}
+	return users
+}
+
+func getEnvironmentsHandler(w http.ResponseWriter, r *http.Request) {
+	environmentsMutex.Lock()
+	defer environmentsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(environments)
+}
+
+func addEnvironmentHandler(w http.ResponseWriter, r *http.Request) {
+	var environment ExecutionEnvironment
+	if err := json.NewDecoder(r.Body).Decode(&environment); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := environment.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	environment.probe()
+
+	environmentsMutex.Lock()
+	defer environmentsMutex.Unlock()
+
+	for _, existing := range environments {
+		if existing.Name == environment.Name {
+			http.Error(w, "Execution environment already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	environmentID++
+	environment.ID = environmentID
+	environment.CreatedAt = time.Now()
+	environment.UpdatedAt = environment.CreatedAt
+	if err := saveEnvironment(environment); err != nil {
+		environmentID--
+		fmt.Printf("[Go] 保存执行环境失败: %v\n", err)
+		http.Error(w, "Failed to save execution environment", http.StatusInternalServerError)
+		return
+	}
+	environments = append(environments, environment)
+	recordAudit(r, "environment.add", "environment/"+environment.Name, nil, environment)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(environment)
+}
+
+// updateEnvironmentHandler 更新执行环境并重新探测版本; 不支持重命名, 模板按名称引用
+func updateEnvironmentHandler(w http.ResponseWriter, r *http.Request) {
+	var environment ExecutionEnvironment
+	if err := json.NewDecoder(r.Body).Decode(&environment); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	existing, ok := findEnvironmentByID(environment.ID)
+	if !ok {
+		http.Error(w, "Execution environment not found", http.StatusNotFound)
+		return
+	}
+	environment.Name = existing.Name
+	if err := environment.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	environment.probe()
+
+	environmentsMutex.Lock()
+	defer environmentsMutex.Unlock()
+
+	for i := range environments {
+		if environments[i].ID != environment.ID {
+			continue
+		}
+		environment.CreatedAt = environments[i].CreatedAt
+		environment.UpdatedAt = time.Now()
+		if err := saveEnvironment(environment); err != nil {
+			fmt.Printf("[Go] 保存执行环境失败: %v\n", err)
+			http.Error(w, "Failed to save execution environment", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "environment.update", "environment/"+environment.Name, environments[i], environment)
+		environments[i] = environment
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(environment)
+		return
+	}
+	http.Error(w, "Execution environment not found", http.StatusNotFound)
+}
+
+// deleteEnvironmentHandler 删除执行环境, 仍被模板引用时返回 409
+func deleteEnvironmentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	existing, ok := findEnvironmentByID(id)
+	if !ok {
+		http.Error(w, "Execution environment not found", http.StatusNotFound)
+		return
+	}
+	if users := environmentUsers(existing.Name); len(users) > 0 {
+		http.Error(w, "Execution environment is used by templates: "+strings.Join(users, ", "), http.StatusConflict)
+		return
+	}
+
+	environmentsMutex.Lock()
+	defer environmentsMutex.Unlock()
+
+	for i, environment := range environments {
+		if environment.ID != id {
+			continue
+		}
+		if err := os.Remove(environmentDataPath(id)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Go] 删除执行环境文件失败: %v\n", err)
+			http.Error(w, "Failed to delete execution environment", http.StatusInternalServerError)
+			return
+		}
+		environments = append(environments[:i], environments[i+1:]...)
+		recordAudit(r, "environment.delete", "environment/"+environment.Name, environment, nil)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "Execution environment not found", http.StatusNotFound)
+}
+
+// probeEnvironmentHandler 重新探测执行环境的版本, 例如在 virtualenv 中升级 ansible-core 之后
+func probeEnvironmentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	environment, ok := refreshEnvironmentProbe(id)
+	if !ok {
+		http.Error(w, "Execution environment not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(environment)
+}
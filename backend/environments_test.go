@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeFakeAnsible 在临时 virtualenv 的 bin 目录中生成 ansible 和 ansible-playbook 脚本, 返回 venv 目录
+func writeFakeAnsible(t *testing.T, script string) string {
+	t.Helper()
+	venv := t.TempDir()
+	bin := filepath.Join(venv, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ansible", "ansible-playbook"} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return venv
+}
+
+const fakeAnsibleVersion = `#!/bin/sh
+cat <<EOF
+ansible [core 2.15.3]
+  config file = ${ANSIBLE_CONFIG:-None}
+  configured module search path = ['/root/.ansible/plugins/modules']
+  ansible python module location = ${VIRTUAL_ENV}/lib/python3.11/site-packages/ansible
+  executable location = $0
+  python version = 3.11.4 (main, Jun  7 2023, 10:13:09) [GCC 12.2.0] (${VIRTUAL_ENV}/bin/python3)
+  jinja version = 3.1.2
+  libyaml = True
+EOF
+`
+
+func TestEnvironmentProbe(t *testing.T) {
+	venv := writeFakeAnsible(t, fakeAnsibleVersion)
+	environment := ExecutionEnvironment{Name: "core215", Venv: venv}
+
+	environment.probe()
+	if environment.ProbeError != "" {
+		t.Fatalf("probe error: %s", environment.ProbeError)
+	}
+	if environment.Version != "ansible [core 2.15.3]" {
+		t.Errorf("Version = %q", environment.Version)
+	}
+	if environment.PythonVersion != "3.11.4" {
+		t.Errorf("PythonVersion = %q", environment.PythonVersion)
+	}
+	if environment.ProbedAt.IsZero() {
+		t.Error("ProbedAt is not set")
+	}
+}
+
+func TestEnvironmentProbeUsesEnvironment(t *testing.T) {
+	// 只有 venv 的 bin 在 PATH 最前面并设置了 env 时才能输出版本
+	venv := writeFakeAnsible(t, `#!/bin/sh
+[ "$(command -v ansible)" = "$VIRTUAL_ENV/bin/ansible" ] || { echo "wrong PATH: $PATH" >&2; exit 3; }
+[ "$EE_MARKER" = "on" ] || { echo "EE_MARKER not set" >&2; exit 4; }
+echo "ansible [core 2.16.0]"
+`)
+	environment := ExecutionEnvironment{Name: "marked", Venv: venv, Env: map[string]string{"EE_MARKER": "on"}}
+
+	environment.probe()
+	if environment.ProbeError != "" {
+		t.Fatalf("probe error: %s", environment.ProbeError)
+	}
+	if environment.Version != "ansible [core 2.16.0]" || environment.PythonVersion != "" {
+		t.Errorf("Version = %q, PythonVersion = %q", environment.Version, environment.PythonVersion)
+	}
+}
+
+func TestEnvironmentProbeError(t *testing.T) {
+	venv := writeFakeAnsible(t, "#!/bin/sh\necho 'ERROR: No module named ansible' >&2\nexit 1\n")
+	environment := ExecutionEnvironment{
+		Name:          "broken",
+		Venv:          venv,
+		Version:       "ansible [core 2.14.0]",
+		PythonVersion: "3.9.2",
+	}
+
+	environment.probe()
+	if !strings.Contains(environment.ProbeError, "exit status 1") || !strings.HasSuffix(environment.ProbeError, ": ERROR: No module named ansible") {
+		t.Errorf("ProbeError = %q", environment.ProbeError)
+	}
+	if environment.Version != "" || environment.PythonVersion != "" {
+		t.Errorf("stale versions kept: %q, %q", environment.Version, environment.PythonVersion)
+	}
+
+	// 可执行文件不存在, 没有输出时错误信息不以 ": " 结尾
+	missing := ExecutionEnvironment{Name: "missing", Venv: filepath.Join(t.TempDir(), "nonexistent")}
+	missing.probe()
+	if missing.ProbeError == "" || strings.HasSuffix(missing.ProbeError, ": ") {
+		t.Errorf("ProbeError = %q", missing.ProbeError)
+	}
+}
+
+func TestEnvironmentBinaries(t *testing.T) {
+	tests := []struct {
+		name        string
+		environment ExecutionEnvironment
+		playbook    string
+		ansible     string
+	}{
+		{
+			name:        "venv",
+			environment: ExecutionEnvironment{Venv: "/opt/venvs/core215"},
+			playbook:    "/opt/venvs/core215/bin/ansible-playbook",
+			ansible:     "/opt/venvs/core215/bin/ansible",
+		},
+		{
+			name:        "ansible-playbook only",
+			environment: ExecutionEnvironment{AnsiblePlaybook: "/opt/ansible-2.16/bin/ansible-playbook"},
+			playbook:    "/opt/ansible-2.16/bin/ansible-playbook",
+			ansible:     "/opt/ansible-2.16/bin/ansible",
+		},
+		{
+			name:        "ansible-playbook outside venv",
+			environment: ExecutionEnvironment{AnsiblePlaybook: "/usr/local/bin/ansible-playbook", Venv: "/opt/venvs/deps"},
+			playbook:    "/usr/local/bin/ansible-playbook",
+			ansible:     "/usr/local/bin/ansible",
+		},
+		{
+			name:        "explicit ansible",
+			environment: ExecutionEnvironment{Venv: "/opt/venvs/core215", Ansible: "/usr/bin/ansible"},
+			playbook:    "/opt/venvs/core215/bin/ansible-playbook",
+			ansible:     "/usr/bin/ansible",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playbook, ansible := tt.environment.binaries()
+			if playbook != tt.playbook || ansible != tt.ansible {
+				t.Errorf("binaries() = %q, %q; want %q, %q", playbook, ansible, tt.playbook, tt.ansible)
+			}
+		})
+	}
+}
+
+func TestEnvironmentEnv(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin:/bin")
+
+	environment := ExecutionEnvironment{
+		Venv:          "/opt/venvs/core215",
+		AnsibleConfig: "/etc/ansible/core215.cfg",
+		Env:           map[string]string{"ANSIBLE_FORCE_COLOR": "1", "HTTPS_PROXY": "http://proxy:3128"},
+	}
+	env := environment.env()
+	want := []string{
+		"VIRTUAL_ENV=/opt/venvs/core215",
+		"PATH=/opt/venvs/core215/bin:/usr/bin:/bin",
+		"ANSIBLE_CONFIG=/etc/ansible/core215.cfg",
+	}
+	if len(env) != len(want)+len(environment.Env) || !reflect.DeepEqual(env[:len(want)], want) {
+		t.Fatalf("env() = %q", env)
+	}
+	extra := append([]string{}, env[len(want):]...)
+	sort.Strings(extra)
+	if wantExtra := []string{"ANSIBLE_FORCE_COLOR=1", "HTTPS_PROXY=http://proxy:3128"}; !reflect.DeepEqual(extra, wantExtra) {
+		t.Errorf("env() extra = %q, want %q", extra, wantExtra)
+	}
+
+	if env := (ExecutionEnvironment{AnsiblePlaybook: "/usr/bin/ansible-playbook"}).env(); len(env) != 0 {
+		t.Errorf("env() without venv = %q, want empty", env)
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 角色与集合存储目录, 启动时由配置设置, 见 loadConfig
+var GALAXY_DIR = defaultConfig.GalaxyDir
+
+const (
+	ROLES_DIR       = "/roles"       // 已安装角色子目录 (ANSIBLE_ROLES_PATH)
+	COLLECTIONS_DIR = "/collections" // 已安装集合子目录 (ANSIBLE_COLLECTIONS_PATH)
+	ARTIFACTS_DIR   = "/artifacts"   // 离线安装包子目录
+
+	maxImportSize     = 64 << 20  // 导入请求最大 64MB
+	maxExtractSize    = 512 << 20 // 单个安装包解压后最大 512MB
+	maxExtractEntries = 10000     // 单个安装包最多包含的条目数
+)
+
+const (
+	RoleKindRole       = "role"
+	RoleKindCollection = "collection"
+)
+
+// galaxyRequirement 对应 requirements.yml 中的一个条目
+type galaxyRequirement struct {
+	Name    string
+	Src     string
+	Version string
+	Kind    string
+}
+
+// 初始化角色与集合目录
+func initGalaxyDirs() error {
+	dirs := []string{
+		filepath.Join(GALAXY_DIR, ROLES_DIR),
+		filepath.Join(GALAXY_DIR, COLLECTIONS_DIR, "ansible_collections"),
+		filepath.Join(GALAXY_DIR, ARTIFACTS_DIR),
+	}
+
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// galaxyEnv 返回运行 ansible 时需要的角色与集合路径环境变量
+func galaxyEnv() []string {
+	rolesPath, _ := filepath.Abs(filepath.Join(GALAXY_DIR, ROLES_DIR))
+	collectionsPath, _ := filepath.Abs(filepath.Join(GALAXY_DIR, COLLECTIONS_DIR))
+	return []string{
+		"ANSIBLE_ROLES_PATH=" + rolesPath,
+		"ANSIBLE_COLLECTIONS_PATH=" + collectionsPath,
+	}
+}
+
+// importRolesHandler 接收角色压缩包或 requirements.yml 并安装到服务端目录
+//
+// 请求为 multipart/form-data:
+//
+//	file      角色压缩包 (.tar.gz/.tgz/.tar) 或 requirements.yml
+//	name      可选, 压缩包安装后的角色名, 默认取文件名
+//	version   可选, 压缩包的版本号
+//	artifacts 可选, 多个离线安装包, 供 requirements.yml 中的条目引用
+func importRolesHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxImportSize); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return
+	}
+
+	// 收集随请求上传的离线安装包
+	artifacts := map[string][]byte{}
+	for _, fh := range r.MultipartForm.File["artifacts"] {
+		f, err := fh.Open()
+		if err != nil {
+			http.Error(w, "Failed to read artifact", http.StatusBadRequest)
+			return
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			http.Error(w, "Failed to read artifact", http.StatusBadRequest)
+			return
+		}
+		artifacts[filepath.Base(fh.Filename)] = content
+	}
+
+	var imported []Role
+	if isRequirementsFile(header.Filename) {
+		fmt.Printf("[Go] 开始根据 %s 安装角色和集合\n", header.Filename)
+		requirements, err := parseRequirements(data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid requirements file: %v", err), http.StatusBadRequest)
+			return
+		}
+		for _, req := range requirements {
+			if err := checkImportName(req); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		for _, req := range requirements {
+			role, err := installRequirement(req, artifacts)
+			if err != nil {
+				fmt.Printf("[Go] 安装 %s 失败: %v\n", req.Name, err)
+				http.Error(w, fmt.Sprintf("Failed to install %s: %v", req.Name, err), http.StatusBadRequest)
+				return
+			}
+			imported = append(imported, role)
+		}
+	} else {
+		name := r.FormValue("name")
+		if name == "" {
+			name = trimArchiveExt(filepath.Base(header.Filename))
+		}
+		req := galaxyRequirement{
+			Name:    name,
+			Src:     filepath.Base(header.Filename),
+			Version: r.FormValue("version"),
+			Kind:    RoleKindRole,
+		}
+		if err := checkImportName(req); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		role, err := installArchive(req, data)
+		if err != nil {
+			fmt.Printf("[Go] 安装角色 %s 失败: %v\n", name, err)
+			http.Error(w, fmt.Sprintf("Failed to install %s: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		imported = append(imported, role)
+	}
+
+	for i := range imported {
+		role, err := registerRole(imported[i])
+		if err != nil {
+			fmt.Printf("[Go] 保存角色 %s 失败: %v\n", imported[i].Name, err)
+			http.Error(w, fmt.Sprintf("Failed to save role: %v", err), http.StatusInternalServerError)
+			return
+		}
+		imported[i] = role
+		recordAudit(r, "role.import", "role/"+role.Name, nil, role)
+	}
+	fmt.Printf("[Go] 成功导入 %d 个角色/集合\n", len(imported))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(imported)
+}
+
+// checkImportName 检查导入的名称是否与其他类型的角色记录冲突
+func checkImportName(req galaxyRequirement) error {
+	rolesMutex.Lock()
+	defer rolesMutex.Unlock()
+
+	for _, role := range roles {
+		if role.Name == req.Name && role.Kind != req.Kind {
+			return fmt.Errorf("role name %q already exists", req.Name)
+		}
+	}
+	return nil
+}
+
+// registerRole 新增或替换同名同类型的角色记录并持久化
+func registerRole(role Role) (Role, error) {
+	rolesMutex.Lock()
+	defer rolesMutex.Unlock()
+
+	for i := range roles {
+		if roles[i].Name != role.Name {
+			continue
+		}
+		if roles[i].Kind != role.Kind {
+			return Role{}, fmt.Errorf("role name %q already exists", role.Name)
+		}
+		role.ID = roles[i].ID
+		role.Description = roles[i].Description
+		role.CreatedAt = roles[i].CreatedAt
+		role.UpdatedAt = time.Now()
+		if err := saveRoleFile(role); err != nil {
+			return Role{}, err
+		}
+		roles[i] = role
+		return role, nil
+	}
+
+	roleID++
+	role.ID = roleID
+	role.CreatedAt = time.Now()
+	role.UpdatedAt = time.Now()
+	if err := saveRoleFile(role); err != nil {
+		return Role{}, err
+	}
+	roles = append(roles, role)
+	return role, nil
+}
+
+// installRequirement 按 requirements.yml 条目查找离线安装包并安装
+func installRequirement(req galaxyRequirement, artifacts map[string][]byte) (Role, error) {
+	for _, candidate := range artifactCandidates(req) {
+		if data, ok := artifacts[candidate]; ok {
+			return installArchive(req, data)
+		}
+	}
+
+	for _, candidate := range artifactCandidates(req) {
+		data, err := ioutil.ReadFile(filepath.Join(GALAXY_DIR, ARTIFACTS_DIR, candidate))
+		if err == nil {
+			return installArchive(req, data)
+		}
+		if !os.IsNotExist(err) {
+			return Role{}, err
+		}
+	}
+
+	return Role{}, fmt.Errorf("no local artifact found (tried %s)", strings.Join(artifactCandidates(req), ", "))
+}
+
+// artifactCandidates 列出一个条目可能对应的安装包文件名
+func artifactCandidates(req galaxyRequirement) []string {
+	var names []string
+	if req.Src != "" && !strings.Contains(req.Src, "://") {
+		names = append(names, filepath.Base(req.Src))
+	}
+
+	base := req.Name
+	if req.Kind == RoleKindCollection {
+		// ansible-galaxy collection build 生成 namespace-name-version.tar.gz
+		base = strings.Replace(req.Name, ".", "-", 1)
+	}
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar"} {
+		if req.Version != "" {
+			names = append(names, base+"-"+req.Version+ext)
+		}
+		names = append(names, base+ext)
+	}
+	return names
+}
+
+// installArchive 解压安装包到对应目录, 已存在的同名角色会被覆盖
+func installArchive(req galaxyRequirement, data []byte) (Role, error) {
+	if !namePattern.MatchString(req.Name) {
+		return Role{}, fmt.Errorf("invalid name %q", req.Name)
+	}
+
+	var dest string
+	if req.Kind == RoleKindCollection {
+		parts := strings.Split(req.Name, ".")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return Role{}, fmt.Errorf("collection name must be namespace.name, got %q", req.Name)
+		}
+		dest = filepath.Join(GALAXY_DIR, COLLECTIONS_DIR, "ansible_collections", parts[0], parts[1])
+	} else {
+		dest = filepath.Join(GALAXY_DIR, ROLES_DIR, req.Name)
+	}
+
+	// 先解压到临时目录, 成功后再替换, 避免安装失败破坏已有版本
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return Role{}, err
+	}
+	staging, err := ioutil.TempDir(filepath.Dir(dest), ".import-*")
+	if err != nil {
+		return Role{}, err
+	}
+	defer os.RemoveAll(staging)
+
+	if err := extractArchive(data, staging); err != nil {
+		return Role{}, err
+	}
+
+	root := archiveContentRoot(staging)
+	role := Role{
+		Name:    req.Name,
+		Kind:    req.Kind,
+		Source:  req.Src,
+		Version: req.Version,
+	}
+	if req.Kind == RoleKindCollection {
+		if version := readCollectionVersion(root); version != "" {
+			role.Version = version
+		}
+	} else {
+		role.Dependencies = readRoleDependencies(root)
+	}
+
+	if err := os.RemoveAll(dest); err != nil {
+		return Role{}, err
+	}
+	if err := os.Rename(root, dest); err != nil {
+		return Role{}, err
+	}
+
+	role.Path = dest
+	fmt.Printf("[Go] 已安装 %s %s %s 到 %s\n", role.Kind, role.Name, role.Version, dest)
+	return role, nil
+}
+
+// extractArchive 解压 tar/tar.gz 数据到指定目录, 拒绝越界路径和链接文件
+func extractArchive(data []byte, dest string) error {
+	var reader io.Reader = bytes.NewReader(data)
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	tr := tar.NewReader(reader)
+	count, entries := 0, 0
+	var total int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid archive: %v", err)
+		}
+		if entries++; entries > maxExtractEntries {
+			return fmt.Errorf("archive has more than %d entries", maxExtractEntries)
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if name == "." {
+			continue
+		}
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("illegal path in archive: %s", header.Name)
+		}
+		target := filepath.Join(dest, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			mode := os.FileMode(0644)
+			if header.FileInfo().Mode()&0111 != 0 {
+				mode = 0755
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			// 按实际读取的数据计算大小, 不信任头部中的 Size
+			n, err := io.Copy(f, io.LimitReader(tr, maxExtractSize-total+1))
+			f.Close()
+			if err != nil {
+				return err
+			}
+			if total += n; total > maxExtractSize {
+				return fmt.Errorf("archive is larger than %d MB when extracted", maxExtractSize>>20)
+			}
+			count++
+		default:
+			// 链接等特殊文件不予安装
+			fmt.Printf("[Go] 跳过压缩包中的特殊文件: %s\n", header.Name)
+		}
+	}
+
+	if count == 0 {
+		return fmt.Errorf("archive is empty")
+	}
+	return nil
+}
+
+// archiveContentSubdirs 是角色和集合自身的子目录, 压缩包中唯一的顶层目录是其中之一时不是外层包装目录
+var archiveContentSubdirs = map[string]bool{
+	"tasks": true, "handlers": true, "defaults": true, "vars": true, "files": true, "templates": true,
+	"meta": true, "library": true, "module_utils": true, "plugins": true, "roles": true, "docs": true, "tests": true,
+}
+
+// archiveContentMarkers 是角色或集合根目录下的标志文件
+var archiveContentMarkers = []string{"meta", "tasks", "galaxy.yml", "MANIFEST.json"}
+
+// archiveContentRoot 压缩包只有一个外层包装目录时 (如 nginx-1.0.0/) 返回该目录;
+// 只有目录名不是角色或集合的子目录, 且其中包含 meta/、tasks/、galaxy.yml 或 MANIFEST.json 时才视为包装目录
+func archiveContentRoot(dir string) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 1 || !entries[0].IsDir() || archiveContentSubdirs[entries[0].Name()] {
+		return dir
+	}
+	wrapper := filepath.Join(dir, entries[0].Name())
+	for _, marker := range archiveContentMarkers {
+		if _, err := os.Stat(filepath.Join(wrapper, marker)); err == nil {
+			return wrapper
+		}
+	}
+	return dir
+}
+
+// readCollectionVersion 从集合的 MANIFEST.json 读取版本号
+func readCollectionVersion(dir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "MANIFEST.json"))
+	if err != nil {
+		return ""
+	}
+	var manifest struct {
+		CollectionInfo struct {
+			Version string `json:"version"`
+		} `json:"collection_info"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return ""
+	}
+	return manifest.CollectionInfo.Version
+}
+
+// readRoleDependencies 读取 meta/main.yml 中的 dependencies 列表
+func readRoleDependencies(dir string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "meta", "main.yml"))
+	if err != nil {
+		return nil
+	}
+
+	var deps []string
+	inDeps := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := stripYAMLComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "-") {
+			inDeps = strings.HasPrefix(line, "dependencies:")
+			continue
+		}
+		if !inDeps {
+			continue
+		}
+		item := strings.TrimSpace(line)
+		if !strings.HasPrefix(item, "-") {
+			continue
+		}
+		item = strings.TrimSpace(strings.TrimPrefix(item, "-"))
+		if strings.HasPrefix(item, "role:") || strings.HasPrefix(item, "name:") {
+			item = strings.TrimSpace(item[strings.Index(item, ":")+1:])
+		} else if strings.Contains(item, ":") {
+			continue
+		}
+		if item = unquoteYAML(item); item != "" {
+			deps = append(deps, item)
+		}
+	}
+	return deps
+}
+
+// parseRequirements 解析 requirements.yml, 支持以下两种格式:
+//
+//   - 顶层列表, 每项为角色
+//   - 包含 roles: 和 collections: 两个列表的映射
+//
+// 列表项可以是字符串 (名称) 或包含 name/src/version 等键的映射
+func parseRequirements(data []byte) ([]galaxyRequirement, error) {
+	var result []galaxyRequirement
+	var current *galaxyRequirement
+	kind := RoleKindRole
+	itemIndent := -1
+
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		if current.Name == "" {
+			current.Name = requirementNameFromSrc(current.Src)
+		}
+		if current.Name == "" {
+			return fmt.Errorf("requirement without name or src")
+		}
+		result = append(result, *current)
+		current = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		raw := stripYAMLComment(scanner.Text())
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		indent := len(raw) - len(strings.TrimLeft(raw, " "))
+
+		// 顶层键: roles: / collections:
+		if indent == 0 && !strings.HasPrefix(trimmed, "-") {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			switch strings.TrimSuffix(trimmed, ":") {
+			case "roles":
+				kind = RoleKindRole
+			case "collections":
+				kind = RoleKindCollection
+			default:
+				return nil, fmt.Errorf("line %d: unsupported key %q", lineNo, trimmed)
+			}
+			itemIndent = -1
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "-") && (itemIndent == -1 || indent == itemIndent) {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			itemIndent = indent
+			current = &galaxyRequirement{Kind: kind}
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+			if trimmed == "" {
+				continue
+			}
+			if !strings.Contains(trimmed, ": ") && !strings.HasSuffix(trimmed, ":") {
+				current.Name = unquoteYAML(trimmed)
+				continue
+			}
+		} else if current == nil {
+			return nil, fmt.Errorf("line %d: unexpected content", lineNo)
+		}
+
+		idx := strings.Index(trimmed, ":")
+		if idx < 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", lineNo)
+		}
+		key := strings.TrimSpace(trimmed[:idx])
+		value := unquoteYAML(strings.TrimSpace(trimmed[idx+1:]))
+		switch key {
+		case "name":
+			current.Name = value
+		case "src", "source":
+			current.Src = value
+		case "version":
+			current.Version = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// requirementNameFromSrc 从 src 推断角色名, 如 ./nginx-1.0.tar.gz -> nginx-1.0
+func requirementNameFromSrc(src string) string {
+	if src == "" {
+		return ""
+	}
+	src = strings.TrimSuffix(src, "/")
+	name := trimArchiveExt(filepath.Base(src))
+	return strings.TrimSuffix(name, ".git")
+}
+
+func isRequirementsFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".yml" || ext == ".yaml"
+}
+
+func trimArchiveExt(name string) string {
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+func stripYAMLComment(line string) string {
+	line = strings.TrimRight(line, " \t\r")
+	if strings.HasPrefix(strings.TrimSpace(line), "#") {
+		return ""
+	}
+	if idx := strings.Index(line, " #"); idx >= 0 {
+		return strings.TrimRight(line[:idx], " ")
+	}
+	return line
+}
+
+func unquoteYAML(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
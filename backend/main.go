@@ -1,14 +1,17 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,19 +19,31 @@ import (
 
 // Host 结构体用于存储主机信息
 type Host struct {
-	ID          int       `json:"id"`
-	Hostname    string    `json:"hostname"`
-	IP          string    `json:"ip"`
-	Group       string    `json:"group"`
-	Status      string    `json:"status"`
-	LastCheck   time.Time `json:"last_check"`
-	Description string    `json:"description"`
+	ID           int       `json:"id"`
+	Hostname     string    `json:"hostname"`
+	IP           string    `json:"ip"`
+	Group        string    `json:"group"`
+	Status       string    `json:"status"`
+	LastCheck    time.Time `json:"last_check"`
+	Description  string    `json:"description"`
+	CredentialID int       `json:"credential_id"` // 连接凭据, 0 表示使用主机组或默认凭据
 }
 
 type AnsibleRequest struct {
-	Playbook  string                 `json:"playbook"`
-	Inventory string                 `json:"inventory"`
-	Variables map[string]interface{} `json:"variables"`
+	Playbook          string                 `json:"playbook"`
+	Inventory         string                 `json:"inventory"`
+	PlaybookTemplate  string                 `json:"playbook_template"`  // 使用已保存的 playbook 模板, 设置后忽略 Playbook
+	InventoryTemplate string                 `json:"inventory_template"` // 使用已保存的 inventory 模板, 设置后忽略 Inventory
+	Variables         map[string]interface{} `json:"variables"`
+	Secrets           []string               `json:"secrets"`            // 以同名变量注入的机密名称
+	CredentialID      int                    `json:"credential_id"`      // 应用于所有主机的连接凭据
+	Timeout           Duration               `json:"timeout"`            // 运行的最长时间, 只能比模板或全局设置更短
+	InactivityTimeout Duration               `json:"inactivity_timeout"` // 没有输出的最长时间, 只能比模板或全局设置更短
+	Adhoc             *AdhocCommand          `json:"adhoc,omitempty"`    // 设置后执行 ad-hoc 命令而不是 playbook
+
+	RunOptions                             // --limit、--tags 等 ansible-playbook 选项
+	ExecutionEnvironment string            `json:"execution_environment,omitempty"` // 执行环境名称, 设置后覆盖模板的设置
+	Env                  map[string]string `json:"env,omitempty"`                   // 额外的环境变量, 名称需要在 run_env_allowlist 中
 }
 
 type AnsibleResponse struct {
@@ -55,33 +70,74 @@ type TaskLog struct {
 
 // 更新 Task 结构体
 type Task struct {
-	ID        int         `json:"id"`
-	Playbook  string      `json:"playbook"`
-	Inventory string      `json:"inventory"`
-	Output    string      `json:"output"`
-	Status    TaskStatus  `json:"status"`
-	Progress  int         `json:"progress"` // 0-100
-	StartTime time.Time   `json:"start_time"`
-	EndTime   *time.Time  `json:"end_time,omitempty"`
-	Timestamp time.Time   `json:"timestamp"`
+	ID                int           `json:"id"`
+	Kind              string        `json:"kind,omitempty"` // playbook、adhoc 或 workflow
+	Adhoc             *AdhocCommand `json:"adhoc,omitempty"`
+	Workflow          *WorkflowRun  `json:"workflow,omitempty"`         // 工作流任务的节点和执行状态
+	WorkflowTaskID    int           `json:"workflow_task_id,omitempty"` // 作为工作流节点执行时的工作流任务
+	WorkflowNode      string        `json:"workflow_node,omitempty"`
+	Playbook          string        `json:"playbook"`
+	Inventory         string        `json:"inventory"`
+	PlaybookTemplate  string        `json:"playbook_template,omitempty"`
+	InventoryTemplate string        `json:"inventory_template,omitempty"`
+	Secrets           []string      `json:"secrets,omitempty"` // 注入的机密名称, 不含值
+	CredentialID      int           `json:"credential_id,omitempty"`
+	UserID            int           `json:"user_id,omitempty"`  // 发起运行的用户, service token 发起时为 0
+	Username          string        `json:"username,omitempty"` // 发起运行的用户名, service token 为 service:<name>
+	TokenID           int           `json:"token_id,omitempty"` // 通过 API token 发起时的 token
+	TokenName         string        `json:"token_name,omitempty"`
+	ScheduleID        int           `json:"schedule_id,omitempty"`        // 由定时计划发起时的计划
+	ParentTaskID      int           `json:"parent_task_id,omitempty"`     // 重新运行时的原任务
+	Timeout           Duration      `json:"timeout,omitempty"`            // 生效的最长运行时间
+	InactivityTimeout Duration      `json:"inactivity_timeout,omitempty"` // 生效的无输出超时
+	Output            string        `json:"output"`
+	Status            TaskStatus    `json:"status"`
+	Progress          int           `json:"progress"` // 0-100
+	StartTime         time.Time     `json:"start_time"`
+	EndTime           *time.Time    `json:"end_time,omitempty"`
+	Timestamp         time.Time     `json:"timestamp"`
+	QueuePosition     int           `json:"queue_position,omitempty"` // 排队等待执行时的位置, 从 1 开始
+	QueueReason       string        `json:"queue_reason,omitempty"`
+	Preview           string        `json:"preview,omitempty"` // 需要审批时的 --check --diff 预览输出
+	Approval          *TaskApproval `json:"approval,omitempty"`
+	HostResults       []HostResult  `json:"host_results,omitempty"` // 从 PLAY RECAP 解析的每台主机结果
+
+	Artifacts      map[string]interface{} `json:"artifacts,omitempty"` // playbook 中 set_stats 设置的数据
+	RunOptions                            // 运行时使用的 ansible-playbook 选项
+	RunEnvironment                        // 运行时使用的执行环境
 }
 
+// 模板和数据目录在启动时由配置设置, 见 loadConfig
+var (
+	TEMPLATES_DIR = defaultConfig.TemplatesDir // 模板文件存储目录
+	DATA_DIR      = defaultConfig.DataDir      // 角色与文件数据存储目录
+)
+
 const (
-	TEMPLATES_DIR = "./templates"  // 模板文件存储目录
 	PLAYBOOK_DIR  = "/playbooks"   // playbook模板子目录
 	INVENTORY_DIR = "/inventories" // inventory模板子目录
 )
 
+const (
+	ROLE_DATA_DIR = "/roles" // 角色数据子目录
+	FILE_DATA_DIR = "/files" // 文件数据子目录
+)
+
+// 角色与文件名称只允许字母、数字、下划线、点和横线
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
 type PlaybookTemplate struct {
 	ID          int       `json:"id"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
 	Content     string    `json:"content"`
 	Type        string    `json:"type"`
-	Variables   []string  `json:"variables"`
+	Variables   []string  `json:"variables"` // playbook 中引用的变量, 由服务端扫描生成
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	Filename    string    `json:"filename"`  // 添加文件名字段
+
+	TemplateSettings // 超时等保存在模板文件以外的设置
 }
 
 // 添加新的结构体
@@ -99,14 +155,18 @@ type PlaybookCheckResponse struct {
 
 // 添加新的结构体
 type Role struct {
-	ID          int       `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Tasks       []Task    `json:"tasks"`
-	Variables   []string  `json:"variables"`
-	Dependencies []string `json:"dependencies"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	Tasks        []Task    `json:"tasks"`
+	Variables    []string  `json:"variables"`
+	Dependencies []string  `json:"dependencies"`
+	Kind         string    `json:"kind,omitempty"`    // role 或 collection, 导入时设置
+	Version      string    `json:"version,omitempty"` // 导入的版本号
+	Source       string    `json:"source,omitempty"`  // 导入来源 (安装包文件名或 src)
+	Path         string    `json:"path,omitempty"`    // 安装目录
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 // 添加新的结构体
@@ -116,6 +176,10 @@ type File struct {
 	Type        string    `json:"type"` // inventory, playbook, config, etc.
 	Content     string    `json:"content"`
 	Description string    `json:"description"`
+	Blob        bool      `json:"blob"`      // 内容保存在 blob 存储中, 通过 /files/download 获取
+	Size        int64     `json:"size"`      // 内容字节数
+	Checksum    string    `json:"checksum"`  // 内容的 SHA-256
+	MimeType    string    `json:"mime_type"` // 探测到的 MIME 类型
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
@@ -171,7 +235,7 @@ func addTaskLog(taskID int, message string, level string) {
 	log := TaskLog{
 		ID:        taskLogID,
 		TaskID:    taskID,
-		Message:   message,
+		Message:   baseRedactor.Redact(message),
 		Level:     level,
 		Timestamp: time.Now(),
 	}
@@ -179,7 +243,6 @@ func addTaskLog(taskID int, message string, level string) {
 }
 
 func getTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
 	taskID := r.URL.Query().Get("task_id")
@@ -206,53 +269,61 @@ func runAnsibleHandler(w http.ResponseWriter, r *http.Request) {
 	// Golang 日志输出到终端
 	fmt.Printf("[Go] 开始处理 Ansible 请求\n")
 
-	// 添加 CORS 头
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == http.MethodOptions {
-		fmt.Printf("[Go] 处理 OPTIONS 请求\n")
+	var req AnsibleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fmt.Printf("[Go] 请求参数无效: %v\n", err)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
-
-	var req AnsibleRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Playbook == "" || req.Inventory == "" {
+	if err := resolveRunTemplates(&req); err != nil {
 		fmt.Printf("[Go] 请求参数无效: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Adhoc != nil {
+		http.Error(w, "Use /adhoc for ad-hoc commands", http.StatusBadRequest)
+		return
+	}
+	if req.Playbook == "" || req.Inventory == "" {
+		fmt.Printf("[Go] 请求参数无效: 缺少 playbook 或 inventory\n")
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	// 创建临时目录
-	tmpDir, err := ioutil.TempDir("", "ansible-*")
-	if err != nil {
-		fmt.Printf("[Go] 创建临时目录失败: %v\n", err)
-		http.Error(w, "Failed to create temp directory", http.StatusInternalServerError)
+	// 在创建任何文件和进程之前检查权限
+	if !authorizeRun(w, r, req) {
 		return
 	}
-	defer os.RemoveAll(tmpDir)
+	serveRun(w, r, req)
+}
 
-	// 保存 playbook 到临时文件
-	playbookFile := filepath.Join(tmpDir, "playbook.yml")
-	if err := ioutil.WriteFile(playbookFile, []byte(req.Playbook), 0644); err != nil {
-		fmt.Printf("[Go] 保存 playbook 文件失败: %v\n", err)
-		http.Error(w, "Failed to save playbook file", http.StatusInternalServerError)
+// serveRun 执行已通过校验和权限检查的运行请求, 以 Server-Sent Events 返回输出
+func serveRun(w http.ResponseWriter, r *http.Request, req AnsibleRequest) {
+	// 服务关闭时不再接受新的运行, 已登记的运行在关闭前会等待其结束
+	if !beginRun() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
 		return
 	}
+	defer endRun()
 
-	// 保存 inventory 到临时文件
-	inventoryFile := filepath.Join(tmpDir, "inventory.ini")
-	if err := ioutil.WriteFile(inventoryFile, []byte(req.Inventory), 0644); err != nil {
-		fmt.Printf("[Go] 保存 inventory 文件失败: %v\n", err)
-		http.Error(w, "Failed to save inventory file", http.StatusInternalServerError)
+	// 准备运行目录: playbook、inventory、机密、凭据和文件
+	run, err := prepareRun(req)
+	if err != nil {
+		fmt.Printf("[Go] 准备运行失败: %v\n", err)
+		if isRunRequestError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
+	defer run.cleanup()
 
-	fmt.Printf("[Go] 临时文件已创建:\nPlaybook: %s\nInventory: %s\n", playbookFile, inventoryFile)
+	fmt.Printf("[Go] 临时文件已创建:\nPlaybook: %s\nInventory: %s\n", run.PlaybookFile, run.InventoryFile)
 
 	// 打印文件内容用于调试
-	fmt.Printf("[Go] Playbook 内容:\n%s\n", req.Playbook)
-	fmt.Printf("[Go] Inventory 内容:\n%s\n", req.Inventory)
+	fmt.Printf("[Go] Playbook 内容:\n%s\n", run.Redactor.Redact(req.Playbook))
+	fmt.Printf("[Go] Inventory 内容:\n%s\n", run.Redactor.Redact(req.Inventory))
 
 	// 设置响应头以支持 Server-Sent Events
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -265,150 +336,87 @@ func runAnsibleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tasksMutex.Lock()
-	taskID++
-	task := Task{
-		ID:        taskID,
-		Playbook:  req.Playbook,
-		Inventory: req.Inventory,
-		Status:    TaskStatusPending,
-		Progress:  0,
-		StartTime: time.Now(),
-		Timestamp: time.Now(),
-	}
-	tasks = append(tasks, task)
-	tasksMutex.Unlock()
-
-	fmt.Printf("[Go] 创建新任务 #%d\n", task.ID)
-
-	// 执行 ansible-playbook 命令
-	cmd := exec.Command("ansible-playbook", "-i", inventoryFile, playbookFile)
-
-	// 设置工作目录为临时目录
-	cmd.Dir = tmpDir
+	user, _ := currentUser(r)
+	apiToken, _ := currentToken(r)
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		fmt.Printf("[Go] 创建标准输出管道失败: %v\n", err)
-		fmt.Fprintf(w, "data: ERROR: Failed to create stdout pipe: %v\n\n", err)
-		flusher.Flush()
-		return
-	}
+	task := createTask(newRunTask(req, run, user, apiToken))
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		fmt.Printf("[Go] 创建标准错误管道失败: %v\n", err)
-		fmt.Fprintf(w, "data: ERROR: Failed to create stderr pipe: %v\n\n", err)
-		flusher.Flush()
-		return
+	fmt.Printf("[Go] 用户 %s 创建新任务 #%d\n", user.Username, task.ID)
+	action := "run"
+	if task.Kind == TaskKindAdhoc {
+		action = "adhoc"
 	}
+	recordAudit(r, action, fmt.Sprintf("task/%d", task.ID), nil, task)
 
-	// 开始执行命令
-	if err := cmd.Start(); err != nil {
-		fmt.Printf("[Go] 启动命令失败: %v\n", err)
-		fmt.Fprintf(w, "data: ERROR: Failed to start command: %v\n\n", err)
-		flusher.Flush()
-		return
-	}
-
-	// 更新任务状态为运行中
-	tasksMutex.Lock()
-	for i := range tasks {
-		if tasks[i].ID == task.ID {
-			tasks[i].Status = TaskStatusRunning
-			break
-		}
-	}
-	tasksMutex.Unlock()
-
-	fmt.Printf("[Go] 任务 #%d 开始执行\n", task.ID)
-
-	// 读取标准输出
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			line := scanner.Text()
-			// Ansible 输出发送到客户端
-			fmt.Fprintf(w, "data: %s\n\n", line)
-			flusher.Flush()
-			// Golang 日志输出到终端
-			fmt.Printf("[Ansible] %s\n", line)
-		}
-	}()
-
-	// 读取标准错误
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			line := scanner.Text()
+	// 写响应需要加锁, 输出由两个 goroutine 回调
+	sse := func(line string, isError bool) {
+		if isError {
 			// Ansible 错误输出发送到客户端
 			fmt.Fprintf(w, "data: ERROR: %s\n\n", line)
-			flusher.Flush()
-			// Golang 日志输出到终端
-			fmt.Printf("[Ansible Error] %s\n", line)
+		} else {
+			// Ansible 输出发送到客户端
+			fmt.Fprintf(w, "data: %s\n\n", line)
 		}
-	}()
+		flusher.Flush()
+	}
 
-	// 等待命令完成
-	err = cmd.Wait()
-	if err != nil {
-		fmt.Printf("[Go] 任务 #%d 执行失败: %v\n", task.ID, err)
+	// 受保护的 inventory 或主机组需要他人审批, 先生成 --check --diff 预览
+	awaiting, err := dispatchRun(task.ID, req, run, sse)
+	if awaiting {
+		fmt.Fprintf(w, "data: Task #%d is awaiting approval\n\n", task.ID)
+	} else if err != nil {
 		fmt.Fprintf(w, "data: ERROR: Command failed: %v\n\n", err)
-		tasksMutex.Lock()
-		for i := range tasks {
-			if tasks[i].ID == task.ID {
-				tasks[i].Status = TaskStatusFailed
-				tasks[i].Output = err.Error()
-				endTime := time.Now()
-				tasks[i].EndTime = &endTime
-				break
-			}
-		}
-		tasksMutex.Unlock()
-		addNotification(NotificationTypeError, fmt.Sprintf("任务 #%d 执行失败", task.ID))
 	} else {
-		fmt.Printf("[Go] 任务 #%d 执行成功\n", task.ID)
 		fmt.Fprintf(w, "data: Command completed successfully\n\n")
-		tasksMutex.Lock()
-		for i := range tasks {
-			if tasks[i].ID == task.ID {
-				tasks[i].Status = TaskStatusComplete
-				tasks[i].Progress = 100
-				endTime := time.Now()
-				tasks[i].EndTime = &endTime
-				break
-			}
-		}
-		tasksMutex.Unlock()
-		addNotification(NotificationTypeSuccess, fmt.Sprintf("任务 #%d 执行成功", task.ID))
 	}
 	flusher.Flush()
 }
 
 func getTasksHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
+	status := TaskStatus(r.URL.Query().Get("status"))
+	queued := runQueueStatus()
+
 	tasksMutex.Lock()
 	defer tasksMutex.Unlock()
-	json.NewEncoder(w).Encode(tasks)
+
+	// 例如 ?status=awaiting_approval 列出等待审批的任务
+	filteredTasks := []Task{}
+	for _, task := range tasks {
+		if status != "" && task.Status != status {
+			continue
+		}
+		// 排队中的任务显示位置和等待原因
+		if q, ok := queued[task.ID]; ok {
+			task.QueuePosition = q.position
+			task.QueueReason = q.reason
+		}
+		filteredTasks = append(filteredTasks, task)
+	}
+	json.NewEncoder(w).Encode(filteredTasks)
 }
 
 // 添加新的处理函数
 func addHostHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	var host Host
 	if err := json.NewDecoder(r.Body).Decode(&host); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	if !authorize(w, r, ActionManageHosts, hostGroupScope(host)) {
+		return
+	}
+	if host.CredentialID != 0 {
+		name := credentialName(host.CredentialID)
+		if name == "" {
+			http.Error(w, "Credential not found", http.StatusBadRequest)
+			return
+		}
+		if !authorize(w, r, ActionUseCredential, hostCredentialScope(host, name)) {
+			return
+		}
+	}
 
 	hostsMutex.Lock()
 	hostID++
@@ -417,13 +425,13 @@ func addHostHandler(w http.ResponseWriter, r *http.Request) {
 	host.LastCheck = time.Now()
 	hosts = append(hosts, host)
 	hostsMutex.Unlock()
+	recordAudit(r, "host.add", fmt.Sprintf("host/%d", host.ID), nil, host)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(host)
 }
 
 func getHostsHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
 	hostsMutex.Lock()
@@ -432,7 +440,9 @@ func getHostsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func checkHostHealth(host *Host) {
-	cmd := exec.Command("ansible", host.Hostname, "-m", "ping")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(serverConfig.HealthCheckTimeout))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, serverConfig.Ansible, host.Hostname, "-m", "ping")
 	err := cmd.Run()
 	
 	host.LastCheck = time.Now()
@@ -444,14 +454,18 @@ func checkHostHealth(host *Host) {
 }
 
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
 	hostsMutex.Lock()
 	defer hostsMutex.Unlock()
 
+	// 只检查当前用户有权管理的主机组
 	for i := range hosts {
-		checkHostHealth(&hosts[i])
+		if canAccess(r, ActionManageHosts, hostGroupScope(hosts[i])) {
+			before := hosts[i]
+			checkHostHealth(&hosts[i])
+			recordAudit(r, "host.health_check", fmt.Sprintf("host/%d", hosts[i].ID), before, hosts[i])
+		}
 	}
 
 	json.NewEncoder(w).Encode(hosts)
@@ -459,14 +473,6 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 
 // 添加新的处理函数
 func addTemplateHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	var template PlaybookTemplate
 	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
@@ -474,51 +480,80 @@ func addTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 根据类型确定文件扩展名和目录
-	var ext, dir string
+	var ext string
 	if template.Type == "playbook" {
 		ext = ".yml"
-		dir = PLAYBOOK_DIR
 	} else if template.Type == "inventory" {
 		ext = ".ini"
-		dir = INVENTORY_DIR
 	} else {
 		http.Error(w, "Invalid template type", http.StatusBadRequest)
 		return
 	}
+	dir, _ := templateDir(template.Type)
+	if err := template.TemplateSettings.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !namePattern.MatchString(template.Name) {
+		fmt.Printf("[Go] 拒绝非法的模板名称: %q\n", template.Name)
+		recordAuditOutcome(r, "template.add", "template/"+template.Type, AuditOutcomeDenied, fmt.Sprintf("invalid template name %q", template.Name))
+		http.Error(w, "Invalid template name", http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, ActionEditTemplates, templateScope(template)) {
+		return
+	}
 
 	// 生成文件名
 	filename := fmt.Sprintf("%s%s", template.Name, ext)
-	filepath := filepath.Join(TEMPLATES_DIR, dir, filename)
+	path, err := templatePath(dir, filename)
+	if err != nil {
+		rejectTemplatePath(w, r, "template.add", template, err)
+		return
+	}
+
+	templatesMutex.Lock()
+	for _, existing := range templates {
+		if existing.Type == template.Type && existing.Name == template.Name {
+			templatesMutex.Unlock()
+			http.Error(w, "Template already exists", http.StatusConflict)
+			return
+		}
+	}
+	templatesMutex.Unlock()
 
 	// 保存文件
-	if err := ioutil.WriteFile(filepath, []byte(template.Content), 0644); err != nil {
+	if err := writeTemplateFile(path, template.Content); err != nil {
+		fmt.Printf("[Go] 保存模板文件失败: %v\n", err)
 		http.Error(w, "Failed to save template file", http.StatusInternalServerError)
 		return
 	}
+	template.Filename = filename
+	if template.Type == "playbook" {
+		template.Variables = surveyVariableNames(template.Content)
+	}
+	if err := saveTemplateSettings(template); err != nil {
+		fmt.Printf("[Go] 保存模板设置失败: %v\n", err)
+		http.Error(w, "Failed to save template settings", http.StatusInternalServerError)
+		return
+	}
 
 	templatesMutex.Lock()
 	templateID++
 	template.ID = templateID
 	template.CreatedAt = time.Now()
 	template.UpdatedAt = time.Now()
-	template.Filename = filename
 	templates = append(templates, template)
 	templatesMutex.Unlock()
+	recordAudit(r, "template.add", "template/"+template.Type+"/"+template.Name, nil, template)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(template)
 }
 
 func getTemplatesHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 	w.Header().Set("Content-Type", "application/json")
 
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	templateType := r.URL.Query().Get("type")
 	
 	templatesMutex.Lock()
@@ -536,28 +571,30 @@ func getTemplatesHandler(w http.ResponseWriter, r *http.Request) {
 
 // 添加新的处理函数
 func checkPlaybookHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	var req PlaybookCheckRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	// 检查使用的是任意内容而非模板, 需要不限范围的执行权限
+	if !authorize(w, r, ActionRun, PermissionScope{}) {
+		return
+	}
 
 	// 使用 ansible-playbook --check 模式来验证 playbook
-	cmd := exec.Command("ansible-playbook", "--check", "-i", req.Inventory, req.Playbook)
+	cmd := exec.Command(serverConfig.AnsiblePlaybook, "--check", "-i", req.Inventory, req.Playbook)
 	output, err := cmd.CombinedOutput()
 
+	redactor, redactErr := newRunRedactor()
+	if redactErr != nil {
+		http.Error(w, "Failed to prepare output redaction", http.StatusInternalServerError)
+		return
+	}
+
 	response := PlaybookCheckResponse{
 		Valid:         err == nil,
 		AffectedHosts: []Host{},
-		Message:       string(output),
+		Message:       redactor.Redact(string(output)),
 	}
 
 	// 如果验证通过，获取受影响的主机
@@ -577,34 +614,139 @@ func checkPlaybookHandler(w http.ResponseWriter, r *http.Request) {
 
 // 添加新的处理函数
 func addRoleHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	var role Role
 	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	if !namePattern.MatchString(role.Name) {
+		http.Error(w, "Invalid role name", http.StatusBadRequest)
+		return
+	}
 
 	rolesMutex.Lock()
-	roleID++
-	role.ID = roleID
+	defer rolesMutex.Unlock()
+
+	for _, existing := range roles {
+		if existing.Name == role.Name {
+			http.Error(w, "Role name already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	// 导入信息只能由 /roles/import 设置
+	role.Kind, role.Version, role.Source, role.Path = "", "", "", ""
+	role.ID = roleID + 1
 	role.CreatedAt = time.Now()
 	role.UpdatedAt = time.Now()
+	if err := saveRoleFile(role); err != nil {
+		fmt.Printf("[Go] 保存角色文件失败: %v\n", err)
+		http.Error(w, "Failed to save role file", http.StatusInternalServerError)
+		return
+	}
+	roleID++
 	roles = append(roles, role)
-	rolesMutex.Unlock()
+	recordAudit(r, "role.add", "role/"+role.Name, nil, role)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(role)
 }
 
+func updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var updatedRole Role
+	if err := json.NewDecoder(r.Body).Decode(&updatedRole); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !namePattern.MatchString(updatedRole.Name) {
+		http.Error(w, "Invalid role name", http.StatusBadRequest)
+		return
+	}
+
+	rolesMutex.Lock()
+	defer rolesMutex.Unlock()
+
+	index := -1
+	for i := range roles {
+		if roles[i].ID == updatedRole.ID {
+			index = i
+		} else if roles[i].Name == updatedRole.Name {
+			http.Error(w, "Role name already exists", http.StatusConflict)
+			return
+		}
+	}
+	if index == -1 {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+
+	existing := roles[index]
+	if existing.Path != "" && existing.Name != updatedRole.Name {
+		http.Error(w, "Imported roles cannot be renamed", http.StatusBadRequest)
+		return
+	}
+
+	updatedRole.Kind = existing.Kind
+	updatedRole.Version = existing.Version
+	updatedRole.Source = existing.Source
+	updatedRole.Path = existing.Path
+	updatedRole.CreatedAt = existing.CreatedAt
+	updatedRole.UpdatedAt = time.Now()
+	if err := saveRoleFile(updatedRole); err != nil {
+		fmt.Printf("[Go] 保存角色文件失败: %v\n", err)
+		http.Error(w, "Failed to save role file", http.StatusInternalServerError)
+		return
+	}
+	if existing.Name != updatedRole.Name {
+		if err := os.Remove(roleDataPath(existing.Name)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Go] 删除旧角色文件失败: %v\n", err)
+		}
+	}
+	roles[index] = updatedRole
+	recordAudit(r, "role.update", "role/"+updatedRole.Name, existing, updatedRole)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updatedRole)
+}
+
+func deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+
+	rolesMutex.Lock()
+	defer rolesMutex.Unlock()
+
+	for i := range roles {
+		if roles[i].ID != id {
+			continue
+		}
+		role := roles[i]
+		if err := os.Remove(roleDataPath(role.Name)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Go] 删除角色文件失败: %v\n", err)
+			http.Error(w, "Failed to delete role file", http.StatusInternalServerError)
+			return
+		}
+		// 同时移除导入时安装的角色或集合目录
+		if role.Path != "" {
+			if err := os.RemoveAll(role.Path); err != nil {
+				fmt.Printf("[Go] 删除角色安装目录失败: %v\n", err)
+			}
+		}
+		roles = append(roles[:i], roles[i+1:]...)
+		recordAudit(r, "role.delete", "role/"+role.Name, role, nil)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(role)
+		return
+	}
+
+	http.Error(w, "Role not found", http.StatusNotFound)
+}
+
 func getRolesHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
 	rolesMutex.Lock()
@@ -614,34 +756,44 @@ func getRolesHandler(w http.ResponseWriter, r *http.Request) {
 
 // 添加新的处理函数
 func addFileHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	var file File
 	if err := json.NewDecoder(r.Body).Decode(&file); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	if !namePattern.MatchString(file.Name) {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
 
 	filesMutex.Lock()
-	fileID++
-	file.ID = fileID
+	defer filesMutex.Unlock()
+
+	for _, existing := range files {
+		if existing.Name == file.Name {
+			http.Error(w, "File name already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	fillTextFileMeta(&file)
+	file.ID = fileID + 1
 	file.CreatedAt = time.Now()
 	file.UpdatedAt = time.Now()
+	if err := saveFileData(file); err != nil {
+		fmt.Printf("[Go] 保存文件数据失败: %v\n", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	fileID++
 	files = append(files, file)
-	filesMutex.Unlock()
+	recordAudit(r, "file.add", "file/"+file.Name, nil, file)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(file)
 }
 
 func getFilesHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
 	fileType := r.URL.Query().Get("type")
@@ -664,32 +816,91 @@ func getFilesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func updateFileHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "PUT, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	var updatedFile File
 	if err := json.NewDecoder(r.Body).Decode(&updatedFile); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	if !namePattern.MatchString(updatedFile.Name) {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
 
 	filesMutex.Lock()
 	defer filesMutex.Unlock()
 
+	index := -1
 	for i := range files {
 		if files[i].ID == updatedFile.ID {
-			updatedFile.CreatedAt = files[i].CreatedAt
-			updatedFile.UpdatedAt = time.Now()
-			files[i] = updatedFile
-			json.NewEncoder(w).Encode(updatedFile)
+			index = i
+		} else if files[i].Name == updatedFile.Name {
+			http.Error(w, "File name already exists", http.StatusConflict)
 			return
 		}
 	}
+	if index == -1 {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	oldName := files[index].Name
+	if files[index].Blob {
+		// 二进制文件只能通过 /files/upload 替换内容
+		updatedFile.Content = ""
+		updatedFile.Blob = true
+		updatedFile.Size = files[index].Size
+		updatedFile.Checksum = files[index].Checksum
+		updatedFile.MimeType = files[index].MimeType
+	} else {
+		fillTextFileMeta(&updatedFile)
+	}
+	updatedFile.CreatedAt = files[index].CreatedAt
+	updatedFile.UpdatedAt = time.Now()
+	if err := saveFileData(updatedFile); err != nil {
+		fmt.Printf("[Go] 保存文件数据失败: %v\n", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	if oldName != updatedFile.Name {
+		if err := os.Remove(fileDataPath(oldName)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Go] 删除旧文件数据失败: %v\n", err)
+		}
+	}
+	recordAudit(r, "file.update", "file/"+updatedFile.Name, files[index], updatedFile)
+	files[index] = updatedFile
+	json.NewEncoder(w).Encode(updatedFile)
+}
+
+func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	for i := range files {
+		if files[i].ID != id {
+			continue
+		}
+		file := files[i]
+		if err := os.Remove(fileDataPath(file.Name)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Go] 删除文件数据失败: %v\n", err)
+			http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+			return
+		}
+		files = append(files[:i], files[i+1:]...)
+		if file.Blob {
+			removeBlobIfUnused(file.Checksum)
+		}
+		recordAudit(r, "file.delete", "file/"+file.Name, file, nil)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(file)
+		return
+	}
 
 	http.Error(w, "File not found", http.StatusNotFound)
 }
@@ -711,7 +922,6 @@ func addNotification(notificationType NotificationType, message string) {
 }
 
 func getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
 	notificationsMutex.Lock()
@@ -720,14 +930,6 @@ func getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func markNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "PUT, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	var req struct {
 		ID int `json:"id"`
 	}
@@ -741,7 +943,9 @@ func markNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
 
 	for i := range notifications {
 		if notifications[i].ID == req.ID {
+			before := notifications[i]
 			notifications[i].Read = true
+			recordAudit(r, "notification.read", fmt.Sprintf("notification/%d", req.ID), before, notifications[i])
 			json.NewEncoder(w).Encode(notifications[i])
 			return
 		}
@@ -782,6 +986,10 @@ func loadTemplatesFromFiles() error {
 	}
 	
 	for _, file := range playbookFiles {
+		// 跳过符号链接等非普通文件, 避免读取模板目录以外的内容
+		if !file.Mode().IsRegular() {
+			continue
+		}
 		if filepath.Ext(file.Name()) == ".yml" || filepath.Ext(file.Name()) == ".yaml" {
 			content, err := ioutil.ReadFile(filepath.Join(TEMPLATES_DIR, PLAYBOOK_DIR, file.Name()))
 			if err != nil {
@@ -794,10 +1002,14 @@ func loadTemplatesFromFiles() error {
 				Name:      strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())),
 				Content:   string(content),
 				Type:      "playbook",
+				Variables: surveyVariableNames(string(content)),
 				Filename:  file.Name(),
 				CreatedAt: file.ModTime(),
 				UpdatedAt: file.ModTime(),
 			}
+			if template.TemplateSettings, err = loadTemplateSettings(template); err != nil {
+				fmt.Printf("[Go] 读取模板设置失败: %v\n", err)
+			}
 			templates = append(templates, template)
 		}
 	}
@@ -815,6 +1027,10 @@ func loadTemplatesFromFiles() error {
 	}
 	
 	for _, file := range inventoryFiles {
+		// 跳过符号链接等非普通文件, 避免读取模板目录以外的内容
+		if !file.Mode().IsRegular() {
+			continue
+		}
 		if filepath.Ext(file.Name()) == ".ini" {
 			content, err := ioutil.ReadFile(filepath.Join(TEMPLATES_DIR, INVENTORY_DIR, file.Name()))
 			if err != nil {
@@ -831,6 +1047,9 @@ func loadTemplatesFromFiles() error {
 				CreatedAt: file.ModTime(),
 				UpdatedAt: file.ModTime(),
 			}
+			if template.TemplateSettings, err = loadTemplateSettings(template); err != nil {
+				fmt.Printf("[Go] 读取模板设置失败: %v\n", err)
+			}
 			templates = append(templates, template)
 		}
 	}
@@ -838,15 +1057,114 @@ func loadTemplatesFromFiles() error {
 	return nil
 }
 
-func updateTemplateHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "PUT, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// 初始化角色与文件数据目录
+func initDataDirs() error {
+	dirs := []string{
+		filepath.Join(DATA_DIR, ROLE_DATA_DIR),
+		filepath.Join(DATA_DIR, FILE_DATA_DIR),
+		filepath.Join(DATA_DIR, BLOB_DATA_DIR),
+	}
 
-	if r.Method == http.MethodOptions {
-		return
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func roleDataPath(name string) string {
+	return filepath.Join(DATA_DIR, ROLE_DATA_DIR, name+".json")
+}
+
+func fileDataPath(name string) string {
+	return filepath.Join(DATA_DIR, FILE_DATA_DIR, name+".json")
+}
+
+// writeJSONFile 先写临时文件再重命名, 避免写入中断留下损坏的数据
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func saveRoleFile(role Role) error {
+	return writeJSONFile(roleDataPath(role.Name), role)
+}
+
+func saveFileData(file File) error {
+	return writeJSONFile(fileDataPath(file.Name), file)
+}
+
+// 从文件系统加载角色
+func loadRolesFromFiles() error {
+	roles = []Role{}
+
+	entries, err := ioutil.ReadDir(filepath.Join(DATA_DIR, ROLE_DATA_DIR))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(DATA_DIR, ROLE_DATA_DIR, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var role Role
+		if err := json.Unmarshal(data, &role); err != nil {
+			fmt.Printf("[Go] 跳过无效的角色文件 %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if role.ID > roleID {
+			roleID = role.ID
+		}
+		roles = append(roles, role)
+	}
+
+	return nil
+}
+
+// 从文件系统加载文件
+func loadFilesFromFiles() error {
+	files = []File{}
+
+	entries, err := ioutil.ReadDir(filepath.Join(DATA_DIR, FILE_DATA_DIR))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(DATA_DIR, FILE_DATA_DIR, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var file File
+		if err := json.Unmarshal(data, &file); err != nil {
+			fmt.Printf("[Go] 跳过无效的文件数据 %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if file.ID > fileID {
+			fileID = file.ID
+		}
+		files = append(files, file)
 	}
 
+	return nil
+}
+
+func updateTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("[Go] 开始处理模板更新请求\n")
 
 	var template PlaybookTemplate
@@ -858,34 +1176,89 @@ func updateTemplateHandler(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Printf("[Go] 收到更新请求: ID=%d, Name=%s, Type=%s\n", template.ID, template.Name, template.Type)
 
-	// 根据类型确定目录
-	var dir string
-	if template.Type == "playbook" {
-		dir = PLAYBOOK_DIR
-	} else if template.Type == "inventory" {
-		dir = INVENTORY_DIR
-	} else {
+	dir, ok := templateDir(template.Type)
+	if !ok {
 		fmt.Printf("[Go] 无效的模板类型: %s\n", template.Type)
 		http.Error(w, "Invalid template type", http.StatusBadRequest)
 		return
 	}
 
+	// 文件名以服务端记录为准, 不使用请求中的 filename
+	templatesMutex.Lock()
+	var existing PlaybookTemplate
+	found := false
+	for _, t := range templates {
+		if t.ID == template.ID {
+			existing = t
+			found = true
+			break
+		}
+	}
+	templatesMutex.Unlock()
+	if !found {
+		fmt.Printf("[Go] 未找到要更新的模板: ID=%d\n", template.ID)
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if existing.Type != template.Type {
+		http.Error(w, "Template type cannot be changed", http.StatusBadRequest)
+		return
+	}
+	if err := template.TemplateSettings.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if template.Filename != "" && template.Filename != existing.Filename {
+		rejectTemplatePath(w, r, "template.update", template, fmt.Errorf("%w: filename %q does not match the stored template", errUnsafePath, template.Filename))
+		return
+	}
+	if template.Name != existing.Name && !namePattern.MatchString(template.Name) {
+		fmt.Printf("[Go] 拒绝非法的模板名称: %q\n", template.Name)
+		recordAuditOutcome(r, "template.update", fmt.Sprintf("template/%s/%s", existing.Type, existing.Name), AuditOutcomeDenied, fmt.Sprintf("invalid template name %q", template.Name))
+		http.Error(w, "Invalid template name", http.StatusBadRequest)
+		return
+	}
+	template.Filename = existing.Filename
+	template.CreatedAt = existing.CreatedAt
+	if template.Type == "playbook" {
+		template.Variables = surveyVariableNames(template.Content)
+	}
+
+	// 修改后的名称和原有名称都需要在权限范围内
+	if !authorize(w, r, ActionEditTemplates, templateScope(template)) {
+		return
+	}
+	if !canAccess(r, ActionEditTemplates, templateScope(existing)) {
+		forbidden(w, r, ActionEditTemplates)
+		return
+	}
+
 	// 更新文件
-	filepath := filepath.Join(TEMPLATES_DIR, dir, template.Filename)
-	fmt.Printf("[Go] 准备更新文件: %s\n", filepath)
+	path, err := templatePath(dir, template.Filename)
+	if err != nil {
+		rejectTemplatePath(w, r, "template.update", existing, err)
+		return
+	}
+	fmt.Printf("[Go] 准备更新文件: %s\n", path)
 
-	if err := ioutil.WriteFile(filepath, []byte(template.Content), 0644); err != nil {
+	if err := writeTemplateFile(path, template.Content); err != nil {
 		fmt.Printf("[Go] 保存文件失败: %v\n", err)
-		http.Error(w, fmt.Sprintf("Failed to save template file: %v", err), http.StatusInternalServerError)
+		http.Error(w, "Failed to save template file", http.StatusInternalServerError)
+		return
+	}
+	if err := saveTemplateSettings(template); err != nil {
+		fmt.Printf("[Go] 保存模板设置失败: %v\n", err)
+		http.Error(w, "Failed to save template settings", http.StatusInternalServerError)
 		return
 	}
 
 	templatesMutex.Lock()
-	found := false
+	found = false
 	for i := range templates {
 		if templates[i].ID == template.ID {
 			fmt.Printf("[Go] 找到要更新的模板: ID=%d\n", template.ID)
 			template.UpdatedAt = time.Now()
+			recordAudit(r, "template.update", "template/"+template.Type+"/"+template.Name, templates[i], template)
 			templates[i] = template
 			json.NewEncoder(w).Encode(template)
 			found = true
@@ -904,41 +1277,211 @@ func updateTemplateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	// 加载配置文件、环境变量和命令行参数
+	if err := loadConfig(os.Args[1:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Printf("Invalid configuration: %v\n", err)
+		}
+		return
+	}
+
 	// 初始化模板目录
 	if err := initTemplatesDirs(); err != nil {
 		fmt.Printf("Failed to initialize template directories: %v\n", err)
 		return
 	}
 
+	// 初始化角色与集合目录
+	if err := initGalaxyDirs(); err != nil {
+		fmt.Printf("Failed to initialize galaxy directories: %v\n", err)
+		return
+	}
+
+	// 初始化角色与文件数据目录
+	if err := initDataDirs(); err != nil {
+		fmt.Printf("Failed to initialize data directories: %v\n", err)
+		return
+	}
+
+	// 加载主密钥和已保存的机密
+	if err := loadMasterKey(); err != nil {
+		fmt.Printf("Failed to load master key: %v\n", err)
+		return
+	}
+	if err := loadSecretsFromFiles(); err != nil {
+		fmt.Printf("Failed to load secrets: %v\n", err)
+		return
+	}
+	if err := loadCredentialsFromFiles(); err != nil {
+		fmt.Printf("Failed to load credentials: %v\n", err)
+		return
+	}
+
+	// 加载用户和 API token, 首次启动时创建 admin 用户
+	if err := loadUsersFromFiles(); err != nil {
+		fmt.Printf("Failed to load users: %v\n", err)
+		return
+	}
+	if err := loadAPITokensFromFiles(); err != nil {
+		fmt.Printf("Failed to load API tokens: %v\n", err)
+		return
+	}
+
+	// 打开审计日志
+	if err := openAuditLog(); err != nil {
+		fmt.Printf("Failed to open audit log: %v\n", err)
+		return
+	}
+
+	// 加载需要审批的 inventory 和主机组
+	if err := loadProtectionRules(); err != nil {
+		fmt.Printf("Failed to load protection rules: %v\n", err)
+		return
+	}
+
+	// 加载允许跨域访问的来源
+	loadAllowedOrigins()
+
+	// 加载输出脱敏配置
+	if err := loadRedactionConfig(); err != nil {
+		fmt.Printf("Failed to load redaction config: %v\n", err)
+		return
+	}
+
 	// 加载已有模板
 	if err := loadTemplatesFromFiles(); err != nil {
 		fmt.Printf("Failed to load templates from files: %v\n", err)
 		return
 	}
 
+	// 加载上次关闭时保存的任务, 恢复等待审批的运行请求
+	if err := loadTasksFromFiles(); err != nil {
+		fmt.Printf("Failed to load tasks from files: %v\n", err)
+		return
+	}
+	restorePendingRuns()
+	if err := loadAnsibleConfig(); err != nil {
+		fmt.Printf("Failed to load ansible.cfg settings: %v\n", err)
+		return
+	}
+	if err := loadEnvironmentsFromFiles(); err != nil {
+		fmt.Printf("Failed to load execution environments: %v\n", err)
+		return
+	}
+	if err := loadWorkflowsFromFiles(); err != nil {
+		fmt.Printf("Failed to load workflows: %v\n", err)
+		return
+	}
+	if err := loadSchedulesFromFiles(); err != nil {
+		fmt.Printf("Failed to load schedules from files: %v\n", err)
+		return
+	}
+
+	// 加载已有角色和文件
+	if err := loadRolesFromFiles(); err != nil {
+		fmt.Printf("Failed to load roles from files: %v\n", err)
+		return
+	}
+	if err := loadFilesFromFiles(); err != nil {
+		fmt.Printf("Failed to load files from disk: %v\n", err)
+		return
+	}
+	fmt.Printf("Loaded %d roles and %d files\n", len(roles), len(files))
+
 	// 打印已加载的模板信息
 	fmt.Printf("Loaded %d templates\n", len(templates))
 	for _, t := range templates {
 		fmt.Printf("Template: %s (Type: %s)\n", t.Name, t.Type)
 	}
 
-	http.HandleFunc("/run", runAnsibleHandler)
-	http.HandleFunc("/tasks", getTasksHandler)
-	http.HandleFunc("/hosts", getHostsHandler)
-	http.HandleFunc("/hosts/add", addHostHandler)
-	http.HandleFunc("/hosts/health", healthCheckHandler)
-	http.HandleFunc("/templates", getTemplatesHandler)
-	http.HandleFunc("/templates/add", addTemplateHandler)
-	http.HandleFunc("/templates/update", updateTemplateHandler)
-	http.HandleFunc("/tasks/logs", getTaskLogsHandler)
-	http.HandleFunc("/playbook/check", checkPlaybookHandler)
-	http.HandleFunc("/roles", getRolesHandler)
-	http.HandleFunc("/roles/add", addRoleHandler)
-	http.HandleFunc("/files", getFilesHandler)
-	http.HandleFunc("/files/add", addFileHandler)
-	http.HandleFunc("/files/update", updateFileHandler)
-	http.HandleFunc("/notifications", getNotificationsHandler)
-	http.HandleFunc("/notifications/read", markNotificationReadHandler)
-	fmt.Println("Server is running on http://localhost:8080")
-	http.ListenAndServe(":8080", nil)
+	route("/auth/login", loginHandler, http.MethodPost)
+	route("/auth/logout", logoutHandler, http.MethodPost)
+	route("/auth/me", currentUserHandler, http.MethodGet)
+	route("/auth/password", changePasswordHandler, http.MethodPut)
+	route("/tokens", getAPITokensHandler, http.MethodGet)
+	route("/tokens/add", addAPITokenHandler, http.MethodPost)
+	route("/tokens/revoke", revokeAPITokenHandler, http.MethodDelete)
+	route("/users", requirePermission(ActionManageUsers, getUsersHandler), http.MethodGet)
+	route("/users/add", requirePermission(ActionManageUsers, addUserHandler), http.MethodPost)
+	route("/users/update", requirePermission(ActionManageUsers, updateUserHandler), http.MethodPut)
+	route("/users/delete", requirePermission(ActionManageUsers, deleteUserHandler), http.MethodDelete)
+	route("/run", requirePermission(ActionRun, runAnsibleHandler), http.MethodPost)
+	route("/adhoc", requirePermission(ActionRun, adhocHandler), http.MethodPost)
+	route("/tasks", requirePermission(ActionView, getTasksHandler), http.MethodGet)
+	route("/tasks/approve", requirePermission(ActionRun, decideTaskHandler(true)), http.MethodPost)
+	route("/tasks/reject", requirePermission(ActionRun, decideTaskHandler(false)), http.MethodPost)
+	route("/tasks/", requirePermission(ActionRun, taskActionHandler), http.MethodPost, http.MethodGet)
+	route("/ansible-config", requirePermission(ActionView, getAnsibleConfigHandler), http.MethodGet)
+	route("/ansible-config/update", requirePermission(ActionManageEnvironments, updateAnsibleConfigHandler), http.MethodPut)
+	route("/execution-environments", requirePermission(ActionView, getEnvironmentsHandler), http.MethodGet)
+	route("/execution-environments/add", requirePermission(ActionManageEnvironments, addEnvironmentHandler), http.MethodPost)
+	route("/execution-environments/update", requirePermission(ActionManageEnvironments, updateEnvironmentHandler), http.MethodPut)
+	route("/execution-environments/delete", requirePermission(ActionManageEnvironments, deleteEnvironmentHandler), http.MethodDelete)
+	route("/execution-environments/probe", requirePermission(ActionManageEnvironments, probeEnvironmentHandler), http.MethodPost)
+	route("/workflows", requirePermission(ActionView, getWorkflowsHandler), http.MethodGet)
+	route("/workflows/add", requirePermission(ActionEditTemplates, addWorkflowHandler), http.MethodPost)
+	route("/workflows/update", requirePermission(ActionEditTemplates, updateWorkflowHandler), http.MethodPut)
+	route("/workflows/delete", requirePermission(ActionEditTemplates, deleteWorkflowHandler), http.MethodDelete)
+	route("/workflows/run", requirePermission(ActionRun, runWorkflowHandler), http.MethodPost)
+	route("/schedules", requirePermission(ActionView, getSchedulesHandler), http.MethodGet)
+	route("/schedules/add", requirePermission(ActionRun, addScheduleHandler), http.MethodPost)
+	route("/schedules/update", requirePermission(ActionRun, updateScheduleHandler), http.MethodPut)
+	route("/schedules/delete", requirePermission(ActionRun, deleteScheduleHandler), http.MethodDelete)
+	route("/protection", requirePermission(ActionView, getProtectionRulesHandler), http.MethodGet)
+	// 只有 admin 拥有 manage_users
+	route("/protection/update", requirePermission(ActionManageUsers, updateProtectionRulesHandler), http.MethodPut)
+	route("/hosts", requirePermission(ActionView, getHostsHandler), http.MethodGet)
+	route("/hosts/add", requirePermission(ActionManageHosts, addHostHandler), http.MethodPost)
+	route("/hosts/health", requirePermission(ActionManageHosts, healthCheckHandler), http.MethodPost)
+	route("/hosts/credential", requirePermission(ActionManageHosts, assignHostCredentialHandler), http.MethodPut)
+	route("/templates", requirePermission(ActionView, getTemplatesHandler), http.MethodGet)
+	route("/templates/add", requirePermission(ActionEditTemplates, addTemplateHandler), http.MethodPost)
+	route("/templates/update", requirePermission(ActionEditTemplates, updateTemplateHandler), http.MethodPut)
+	route("/templates/survey/suggest", requirePermission(ActionEditTemplates, suggestSurveyHandler), http.MethodPost)
+	route("/tasks/logs", requirePermission(ActionView, getTaskLogsHandler), http.MethodGet)
+	route("/playbook/check", requirePermission(ActionRun, checkPlaybookHandler), http.MethodPost)
+	route("/roles", requirePermission(ActionView, getRolesHandler), http.MethodGet)
+	route("/roles/add", requirePermission(ActionManageRoles, addRoleHandler), http.MethodPost)
+	route("/roles/update", requirePermission(ActionManageRoles, updateRoleHandler), http.MethodPut)
+	route("/roles/delete", requirePermission(ActionManageRoles, deleteRoleHandler), http.MethodDelete)
+	route("/roles/import", requirePermission(ActionManageRoles, importRolesHandler), http.MethodPost)
+	route("/files", requirePermission(ActionView, getFilesHandler), http.MethodGet)
+	route("/files/add", requirePermission(ActionManageFiles, addFileHandler), http.MethodPost)
+	route("/files/update", requirePermission(ActionManageFiles, updateFileHandler), http.MethodPut)
+	route("/files/delete", requirePermission(ActionManageFiles, deleteFileHandler), http.MethodDelete)
+	route("/files/upload", requirePermission(ActionManageFiles, uploadFileHandler), http.MethodPost)
+	route("/files/download", requirePermission(ActionView, downloadFileHandler), http.MethodGet)
+	route("/secrets", requirePermission(ActionView, getSecretsHandler), http.MethodGet)
+	route("/secrets/add", requirePermission(ActionManageSecrets, addSecretHandler), http.MethodPost)
+	route("/secrets/update", requirePermission(ActionManageSecrets, updateSecretHandler), http.MethodPut)
+	route("/secrets/delete", requirePermission(ActionManageSecrets, deleteSecretHandler), http.MethodDelete)
+	route("/credentials", requirePermission(ActionView, getCredentialsHandler), http.MethodGet)
+	route("/credentials/add", requirePermission(ActionManageSecrets, addCredentialHandler), http.MethodPost)
+	route("/credentials/update", requirePermission(ActionManageSecrets, updateCredentialHandler), http.MethodPut)
+	route("/credentials/delete", requirePermission(ActionManageSecrets, deleteCredentialHandler), http.MethodDelete)
+	route("/audit", requirePermission(ActionViewAudit, getAuditHandler), http.MethodGet)
+	// 只有 admin 拥有 manage_users
+	route("/config", requirePermission(ActionManageUsers, getConfigHandler), http.MethodGet)
+	route("/notifications", requirePermission(ActionView, getNotificationsHandler), http.MethodGet)
+	route("/notifications/read", requirePermission(ActionView, markNotificationReadHandler), http.MethodPut)
+	// 除登录接口外, 所有接口都需要登录; 各接口所需的权限见上方的 requirePermission,
+	// 跨域、安全响应头和请求体大小由 securityMiddleware 统一处理
+	server := &http.Server{
+		Addr:              serverConfig.Listen,
+		Handler:           securityMiddleware(authMiddleware(http.DefaultServeMux)),
+		ReadHeaderTimeout: time.Duration(serverConfig.ReadHeaderTimeout),
+	}
+	go runScheduler()
+
+	// 收到 SIGINT/SIGTERM 后停止接受请求和新的运行, 等待进行中的运行结束 (超过 shutdown_timeout 后取消),
+	// 保存任务状态后关闭 shutdownDone
+	shutdownDone := make(chan struct{})
+	go handleShutdownSignals(server, shutdownDone)
+
+	fmt.Printf("Server is running on %s\n", serverConfig.Listen)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Printf("Server stopped: %v\n", err)
+		return
+	}
+	<-shutdownDone
 }
\ No newline at end of file
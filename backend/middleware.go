@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxRequestBodySize = 8 << 20 // 普通请求体上限, 上传接口单独设置
+	corsMaxAge         = "600"
+)
+
+var (
+	allowedOrigins = map[string]bool{}
+	allowAnyOrigin bool
+
+	// routeMethods 记录每个接口允许的方法, 用于方法检查和跨域预检
+	routeMethods = map[string][]string{}
+)
+
+// 上传接口的请求体上限
+var bodyLimits = map[string]int64{
+	"/files/upload": maxUploadSize + (1 << 20),
+	"/roles/import": maxImportSize,
+}
+
+// loadAllowedOrigins 根据配置中的 allowed_origins 设置允许的跨域来源
+func loadAllowedOrigins() {
+	for _, origin := range serverConfig.AllowedOrigins {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "*" {
+			allowAnyOrigin = true
+			fmt.Printf("[Go] 警告: 允许任意来源跨域访问\n")
+		} else if origin != "" {
+			allowedOrigins[origin] = true
+		}
+	}
+}
+
+func originAllowed(origin string) bool {
+	return allowAnyOrigin || allowedOrigins[origin]
+}
+
+// route 注册接口并限制允许的方法, GET 接口同时接受 HEAD
+func route(pattern string, handler http.HandlerFunc, methods ...string) {
+	routeMethods[pattern] = methods
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+				handler(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+}
+
+// securityMiddleware 统一设置安全响应头、处理跨域和预检请求, 并限制请求体大小
+func securityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "no-referrer")
+		header.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		header.Set("Cache-Control", "no-store")
+		if r.TLS != nil {
+			header.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			header.Add("Vary", "Origin")
+			if originAllowed(origin) {
+				if allowAnyOrigin {
+					header.Set("Access-Control-Allow-Origin", "*")
+				} else {
+					header.Set("Access-Control-Allow-Origin", origin)
+				}
+				header.Set("Access-Control-Expose-Headers", "Content-Disposition, ETag, X-Checksum-Sha256")
+			}
+		}
+
+		// 预检请求不携带凭据, 在认证之前应答
+		if r.Method == http.MethodOptions {
+			// 按注册的模式查找
+			_, pattern := http.DefaultServeMux.Handler(r)
+			methods, ok := routeMethods[pattern]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			allow := strings.Join(append(append([]string{}, methods...), http.MethodOptions), ", ")
+			header.Set("Allow", allow)
+			if origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+				if !originAllowed(origin) {
+					http.Error(w, "Origin not allowed", http.StatusForbidden)
+					return
+				}
+				header.Set("Access-Control-Allow-Methods", allow)
+				header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Range")
+				header.Set("Access-Control-Max-Age", corsMaxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		limit, ok := bodyLimits[r.URL.Path]
+		if !ok {
+			limit = maxRequestBodySize
+		}
+		if r.ContentLength > limit {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errUnsafePath 表示文件名会写到模板目录以外, 或目标不是普通文件
+var errUnsafePath = errors.New("unsafe template path")
+
+// templateDir 返回模板类型对应的子目录
+func templateDir(templateType string) (string, bool) {
+	switch templateType {
+	case "playbook":
+		return PLAYBOOK_DIR, true
+	case "inventory":
+		return INVENTORY_DIR, true
+	}
+	return "", false
+}
+
+// templatePath 返回模板文件在模板目录中的实际路径; 文件名只能是单个路径元素,
+// 子目录解析符号链接后必须仍在模板根目录内, 已存在的目标必须是普通文件而不是符号链接
+func templatePath(dir, filename string) (string, error) {
+	if filename == "" || filename == "." || filename == ".." || filename != filepath.Base(filename) || strings.ContainsAny(filename, `/\`+"\x00") {
+		return "", fmt.Errorf("%w: invalid file name %q", errUnsafePath, filename)
+	}
+
+	root, err := filepath.EvalSymlinks(TEMPLATES_DIR)
+	if err != nil {
+		return "", err
+	}
+	realDir, err := filepath.EvalSymlinks(filepath.Join(TEMPLATES_DIR, dir))
+	if err != nil {
+		return "", err
+	}
+	if !pathWithin(root, realDir) {
+		return "", fmt.Errorf("%w: %s resolves outside the templates directory", errUnsafePath, dir)
+	}
+
+	path := filepath.Join(realDir, filename)
+	info, err := os.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err == nil && !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%w: %s is not a regular file", errUnsafePath, filename)
+	}
+	return path, nil
+}
+
+// pathWithin 判断 path 是否是 root 或其子路径, 两者都需要是已解析符号链接的路径
+func pathWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// writeTemplateFile 先写入同目录的临时文件再重命名, 重命名会替换而不会跟随目标位置的符号链接
+func writeTemplateFile(path, content string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".template-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// rejectTemplatePath 记录并拒绝不安全的模板路径, 其他错误返回 500
+func rejectTemplatePath(w http.ResponseWriter, r *http.Request, action string, template PlaybookTemplate, err error) {
+	if !errors.Is(err, errUnsafePath) {
+		fmt.Printf("[Go] 解析模板路径失败: %v\n", err)
+		http.Error(w, "Failed to resolve template path", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("[Go] 拒绝不安全的模板路径: %v\n", err)
+	recordAuditOutcome(r, action, fmt.Sprintf("template/%s/%s", template.Type, template.Name), AuditOutcomeDenied, err.Error())
+	http.Error(w, "Invalid template path", http.StatusBadRequest)
+}
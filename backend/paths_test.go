@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupTemplatesDir 使用临时目录作为模板目录, 返回模板目录和目录外的一个文件
+func setupTemplatesDir(t *testing.T) (string, string) {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "templates")
+	for _, dir := range []string{PLAYBOOK_DIR, INVENTORY_DIR} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outside := filepath.Join(base, "outside.yml")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old := TEMPLATES_DIR
+	TEMPLATES_DIR = root
+	t.Cleanup(func() { TEMPLATES_DIR = old })
+	return root, outside
+}
+
+func TestTemplatePathRejectsUnsafeNames(t *testing.T) {
+	setupTemplatesDir(t)
+
+	tests := []struct {
+		name     string
+		filename string
+	}{
+		{"empty", ""},
+		{"dot", "."},
+		{"dot dot", ".."},
+		{"parent traversal", "../outside.yml"},
+		{"deep traversal", "../../../etc/passwd"},
+		{"nested traversal", "sub/../../outside.yml"},
+		{"subdirectory", "sub/site.yml"},
+		{"absolute", "/etc/passwd"},
+		{"absolute inside templates", filepath.Join(TEMPLATES_DIR, PLAYBOOK_DIR, "site.yml")},
+		{"nul byte", "site.yml\x00.txt"},
+		{"trailing nul byte", "site.yml\x00"},
+		{"windows traversal", `..\outside.yml`},
+		{"windows subdirectory", `sub\site.yml`},
+		{"windows absolute", `C:\Windows\win.ini`},
+		{"windows unc", `\\server\share\site.yml`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := templatePath(PLAYBOOK_DIR, tt.filename)
+			if !errors.Is(err, errUnsafePath) {
+				t.Fatalf("templatePath(%q) = %q, %v; want errUnsafePath", tt.filename, path, err)
+			}
+		})
+	}
+}
+
+func TestTemplatePathAcceptsPlainNames(t *testing.T) {
+	root, _ := setupTemplatesDir(t)
+
+	tests := []struct {
+		dir      string
+		filename string
+	}{
+		{PLAYBOOK_DIR, "site.yml"},
+		{PLAYBOOK_DIR, "deploy-app_v2.yaml"},
+		{PLAYBOOK_DIR, "..hidden.yml"},
+		{INVENTORY_DIR, "staging.ini"},
+	}
+	for _, tt := range tests {
+		path, err := templatePath(tt.dir, tt.filename)
+		if err != nil {
+			t.Errorf("templatePath(%q, %q): %v", tt.dir, tt.filename, err)
+			continue
+		}
+		if want := filepath.Join(root, tt.dir, tt.filename); path != want {
+			t.Errorf("templatePath(%q, %q) = %q, want %q", tt.dir, tt.filename, path, want)
+		}
+	}
+}
+
+func TestTemplatePathRejectsSymlinkEscape(t *testing.T) {
+	root, outside := setupTemplatesDir(t)
+	playbooks := filepath.Join(root, PLAYBOOK_DIR)
+
+	// 模板目录中指向目录外文件的符号链接
+	if err := os.Symlink(outside, filepath.Join(playbooks, "link.yml")); err != nil {
+		t.Fatal(err)
+	}
+	// 指向不存在目标的符号链接, 写入时会在目录外创建文件
+	if err := os.Symlink(filepath.Join(filepath.Dir(outside), "created.yml"), filepath.Join(playbooks, "dangling.yml")); err != nil {
+		t.Fatal(err)
+	}
+	// 模板目录中的子目录
+	if err := os.Mkdir(filepath.Join(playbooks, "dir.yml"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{"link.yml", "dangling.yml", "dir.yml"} {
+		if path, err := templatePath(PLAYBOOK_DIR, filename); !errors.Is(err, errUnsafePath) {
+			t.Errorf("templatePath(%q) = %q, %v; want errUnsafePath", filename, path, err)
+		}
+	}
+
+	// 类型子目录本身是指向模板目录以外的符号链接
+	escaped := filepath.Join(filepath.Dir(outside), "escaped")
+	if err := os.Mkdir(escaped, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, INVENTORY_DIR)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(escaped, filepath.Join(root, INVENTORY_DIR)); err != nil {
+		t.Fatal(err)
+	}
+	if path, err := templatePath(INVENTORY_DIR, "hosts.ini"); !errors.Is(err, errUnsafePath) {
+		t.Errorf("templatePath through escaping directory = %q, %v; want errUnsafePath", path, err)
+	}
+}
+
+func TestPathWithin(t *testing.T) {
+	root := filepath.FromSlash("/srv/templates")
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/srv/templates", true},
+		{"/srv/templates/playbooks", true},
+		{"/srv/templates/playbooks/site.yml", true},
+		{"/srv/templates/..hidden", true},
+		{"/srv", false},
+		{"/srv/templates-other", false},
+		{"/srv/templates/../data", false},
+		{"/etc/passwd", false},
+		{"relative/path", false},
+	}
+	for _, tt := range tests {
+		if got := pathWithin(root, filepath.FromSlash(tt.path)); got != tt.want {
+			t.Errorf("pathWithin(%q, %q) = %v, want %v", root, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// runWaiter 是排队等待执行的运行
+type runWaiter struct {
+	taskID int
+	user   string
+	locks  []string
+	ready  chan struct{}
+	reason string // 当前等待的原因
+}
+
+var (
+	runQueue      []*runWaiter
+	runningTotal  int
+	runningByUser = map[string]int{}
+	heldRunLocks  = map[string]int{} // 锁 -> 持有锁的任务
+	runQueueMutex sync.Mutex
+)
+
+// runLocks 返回运行需要独占的锁: inventory 模板以及 inventory 中的每个主机组
+func runLocks(inventoryTemplate string, groups []string) []string {
+	var locks []string
+	if inventoryTemplate != "" {
+		locks = append(locks, "inventory/"+inventoryTemplate)
+	}
+	for _, group := range groups {
+		locks = append(locks, "group/"+group)
+	}
+	return locks
+}
+
+// blockedBy 返回运行不能开始的原因, 可以开始时返回空字符串; 调用方需要持有 runQueueMutex
+func (w *runWaiter) blockedBy() string {
+	if limit := serverConfig.MaxConcurrentRuns; limit > 0 && runningTotal >= limit {
+		return fmt.Sprintf("waiting for a free run slot (%d running)", runningTotal)
+	}
+	if limit := serverConfig.MaxRunsPerUser; limit > 0 && runningByUser[w.user] >= limit {
+		return fmt.Sprintf("waiting for %s's other runs to finish (%d running)", w.user, runningByUser[w.user])
+	}
+	for _, lock := range w.locks {
+		if holder, ok := heldRunLocks[lock]; ok {
+			return fmt.Sprintf("waiting for task #%d which holds %s", holder, lock)
+		}
+	}
+	return ""
+}
+
+// dispatchRunQueue 按排队顺序启动所有可以开始的运行, 被阻塞的运行不影响后面无冲突的运行;
+// 调用方需要持有 runQueueMutex
+func dispatchRunQueue() {
+	remaining := runQueue[:0]
+	for _, w := range runQueue {
+		if w.reason = w.blockedBy(); w.reason != "" {
+			remaining = append(remaining, w)
+			continue
+		}
+		runningTotal++
+		runningByUser[w.user]++
+		for _, lock := range w.locks {
+			heldRunLocks[lock] = w.taskID
+		}
+		close(w.ready)
+	}
+	for i := len(remaining); i < len(runQueue); i++ {
+		runQueue[i] = nil
+	}
+	runQueue = remaining
+}
+
+// acquireRunSlot 等待并占用一个执行名额和所需的锁, 返回释放函数;
+// 排队期间服务关闭时返回错误, onQueued 在需要排队时以等待原因调用一次
+func acquireRunSlot(taskID int, user string, locks []string, onQueued func(reason string)) (func(), error) {
+	w := &runWaiter{taskID: taskID, user: user, locks: locks, ready: make(chan struct{})}
+
+	runQueueMutex.Lock()
+	runQueue = append(runQueue, w)
+	dispatchRunQueue()
+	reason := w.reason
+	runQueueMutex.Unlock()
+
+	release := func() {
+		runQueueMutex.Lock()
+		defer runQueueMutex.Unlock()
+		runningTotal--
+		runningByUser[user]--
+		if runningByUser[user] <= 0 {
+			delete(runningByUser, user)
+		}
+		for _, lock := range locks {
+			if heldRunLocks[lock] == taskID {
+				delete(heldRunLocks, lock)
+			}
+		}
+		dispatchRunQueue()
+	}
+
+	if reason != "" && onQueued != nil {
+		onQueued(reason)
+	}
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-runsContext.Done():
+	}
+
+	// 服务关闭; 如果恰好已经获得名额则释放
+	runQueueMutex.Lock()
+	select {
+	case <-w.ready:
+		runQueueMutex.Unlock()
+		release()
+	default:
+		for i, queued := range runQueue {
+			if queued == w {
+				runQueue = append(runQueue[:i], runQueue[i+1:]...)
+				break
+			}
+		}
+		runQueueMutex.Unlock()
+	}
+	return nil, fmt.Errorf("server is shutting down")
+}
+
+// queuedRun 是排队中任务的位置 (从 1 开始) 和等待原因
+type queuedRun struct {
+	position int
+	reason   string
+}
+
+func runQueueStatus() map[int]queuedRun {
+	runQueueMutex.Lock()
+	defer runQueueMutex.Unlock()
+
+	status := make(map[int]queuedRun, len(runQueue))
+	for i, w := range runQueue {
+		status[w.taskID] = queuedRun{position: i + 1, reason: w.reason}
+	}
+	return status
+}
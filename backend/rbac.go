@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// UserRole 是用户的基础角色, 决定默认拥有的权限
+type UserRole string
+
+const (
+	UserRoleViewer   UserRole = "viewer"
+	UserRoleOperator UserRole = "operator"
+	UserRoleAdmin    UserRole = "admin"
+)
+
+// Action 是权限控制的操作
+type Action string
+
+const (
+	ActionView               Action = "view"                // 查看任务、主机、模板等
+	ActionRun                Action = "run"                 // 执行和检查 playbook
+	ActionEditTemplates      Action = "edit_templates"      // 新增和修改 playbook/inventory 模板
+	ActionManageHosts        Action = "manage_hosts"        // 新增主机、分配凭据、健康检查
+	ActionManageRoles        Action = "manage_roles"        // 管理和导入角色与集合
+	ActionManageFiles        Action = "manage_files"        // 管理文件
+	ActionManageSecrets      Action = "manage_secrets"      // 管理机密和连接凭据
+	ActionManageUsers        Action = "manage_users"        // 管理用户和权限
+	ActionViewAudit          Action = "view_audit"          // 查询和导出审计日志
+	ActionManageEnvironments Action = "manage_environments" // 管理执行环境 (ansible 可执行文件和 virtualenv)
+	ActionUseCredential      Action = "use_credential"      // 在运行请求中以 credential_id 使用连接凭据
+)
+
+var validActions = map[Action]bool{
+	ActionView:               true,
+	ActionRun:                true,
+	ActionEditTemplates:      true,
+	ActionManageHosts:        true,
+	ActionManageRoles:        true,
+	ActionManageFiles:        true,
+	ActionManageSecrets:      true,
+	ActionManageUsers:        true,
+	ActionViewAudit:          true,
+	ActionManageEnvironments: true,
+	ActionUseCredential:      true,
+}
+
+// Permission 授予一个操作, 作用范围为空表示不限制;
+// 范围支持 * 通配, 例如 {"action": "run", "playbooks": ["deploy.yml"], "inventories": ["staging"]}
+type Permission struct {
+	Action      Action   `json:"action"`
+	Playbooks   []string `json:"playbooks,omitempty"`   // playbook 模板名称
+	Inventories []string `json:"inventories,omitempty"` // inventory 模板名称
+	Groups      []string `json:"groups,omitempty"`      // 主机组
+	Credentials []string `json:"credentials,omitempty"` // 连接凭据名称, 只用于 use_credential
+}
+
+// PermissionScope 描述一次操作涉及的模板和主机组
+type PermissionScope struct {
+	Playbook   string   // playbook 模板名称, 未使用模板时为空
+	Inventory  string   // inventory 模板名称, 未使用模板时为空
+	Groups     []string // 涉及的主机组
+	Credential string   // 使用的连接凭据名称
+}
+
+// 各角色默认拥有的权限, admin 拥有全部权限;
+// 需要限定范围时, 使用 viewer 角色并为用户单独授予带范围的权限
+var rolePermissions = map[UserRole][]Permission{
+	UserRoleViewer: {
+		{Action: ActionView},
+	},
+	UserRoleOperator: {
+		{Action: ActionView},
+		{Action: ActionRun},
+		{Action: ActionUseCredential},
+		{Action: ActionManageHosts},
+	},
+}
+
+// userPermissions 返回用户角色的默认权限和单独授予的权限
+func userPermissions(user User) []Permission {
+	return append(append([]Permission{}, rolePermissions[user.Role]...), user.Permissions...)
+}
+
+// userHasAction 判断用户是否在任意范围内拥有该操作的权限
+func userHasAction(user User, action Action) bool {
+	if user.Role == UserRoleAdmin {
+		return true
+	}
+	for _, permission := range userPermissions(user) {
+		if permission.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// userCan 判断用户是否可以在给定范围内执行操作
+func userCan(user User, action Action, scope PermissionScope) bool {
+	if user.Role == UserRoleAdmin {
+		return true
+	}
+	for _, permission := range userPermissions(user) {
+		if permission.Action == action && permission.covers(scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers 判断权限范围是否包含给定范围, 涉及多个主机组时每个组都需要在范围内
+func (p Permission) covers(scope PermissionScope) bool {
+	if len(p.Playbooks) > 0 && !matchTemplateName(p.Playbooks, scope.Playbook) {
+		return false
+	}
+	if len(p.Inventories) > 0 && !matchTemplateName(p.Inventories, scope.Inventory) {
+		return false
+	}
+	if len(p.Credentials) > 0 && (scope.Credential == "" || !matchPatterns(p.Credentials, scope.Credential)) {
+		return false
+	}
+	if len(p.Groups) > 0 {
+		if len(scope.Groups) == 0 {
+			return false
+		}
+		for _, group := range scope.Groups {
+			if !matchPatterns(p.Groups, group) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchTemplateName 匹配模板名称, 模式可以带 .yml/.yaml/.ini 扩展名
+func matchTemplateName(patterns []string, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		for _, ext := range []string{".yml", ".yaml", ".ini"} {
+			pattern = strings.TrimSuffix(pattern, ext)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPatterns(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePermissions 校验角色和权限, 用于新增和修改用户
+func validatePermissions(role UserRole, permissions []Permission) error {
+	if role != UserRoleViewer && role != UserRoleOperator && role != UserRoleAdmin {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	for _, permission := range permissions {
+		if !validActions[permission.Action] {
+			return fmt.Errorf("invalid action %q", permission.Action)
+		}
+		// 能管理用户就能给自己授权, 因此只授予 admin 角色
+		if permission.Action == ActionManageUsers {
+			return fmt.Errorf("action %q requires the admin role", permission.Action)
+		}
+		if len(permission.Credentials) > 0 && permission.Action != ActionUseCredential {
+			return fmt.Errorf("credentials can only scope the %q action", ActionUseCredential)
+		}
+		patterns := append(append(append([]string{}, permission.Playbooks...), permission.Inventories...), permission.Groups...)
+		patterns = append(patterns, permission.Credentials...)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("invalid pattern %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// requirePermission 包装处理函数, 要求当前用户至少在某个范围内拥有该操作的权限,
+// 使用 API token 时还要求 token 的 scopes 包含该操作; 带范围的检查由处理函数通过 authorize 完成
+func requirePermission(action Action, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(r)
+		if !ok || !userHasAction(user, action) || !tokenAllows(r, action) {
+			forbidden(w, r, action)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// authorize 检查当前用户是否可以在给定范围内执行操作, 不允许时返回 403
+func authorize(w http.ResponseWriter, r *http.Request, action Action, scope PermissionScope) bool {
+	if canAccess(r, action, scope) {
+		return true
+	}
+	forbidden(w, r, action)
+	return false
+}
+
+// canAccess 与 authorize 相同, 但不写响应, 用于过滤列表
+func canAccess(r *http.Request, action Action, scope PermissionScope) bool {
+	user, ok := currentUser(r)
+	return ok && userCan(user, action, scope) && tokenAllows(r, action)
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request, action Action) {
+	user, _ := currentUser(r)
+	fmt.Printf("[Go] 用户 %q 无权执行 %s: %s %s\n", user.Username, action, r.Method, r.URL.Path)
+	recordAuditOutcome(r, "access.denied", r.URL.Path, AuditOutcomeDenied, "requires "+string(action))
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+// inventoryGroups 解析 INI 格式 inventory 中的主机组, 不属于任何组的主机归入 ungrouped
+func inventoryGroups(content string) []string {
+	var groups []string
+	seen := map[string]bool{}
+	add := func(group string) {
+		if group != "" && !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+
+	inGroup := false
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if i := strings.Index(name, ":"); i >= 0 {
+				name = name[:i]
+			}
+			add(name)
+			inGroup = true
+			continue
+		}
+		if !inGroup {
+			add("ungrouped")
+		}
+	}
+	return groups
+}
+
+// inventoryHosts 解析 INI 格式 inventory 中的主机名, 忽略 :vars 和 :children 节
+func inventoryHosts(content string) []string {
+	var hosts []string
+	seen := map[string]bool{}
+	hostSection := true
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			hostSection = !strings.Contains(line, ":")
+			continue
+		}
+		if !hostSection {
+			continue
+		}
+		if name := strings.Fields(line)[0]; !seen[name] {
+			seen[name] = true
+			hosts = append(hosts, name)
+		}
+	}
+	return hosts
+}
+
+// inventoryVarNames 返回 INI 格式 inventory 中设置的变量名, 包括主机行中的 key=value 和 :vars 节中的设置;
+// 引号中的值不做解析, 其中形如 key=value 的内容也会返回
+func inventoryVarNames(content string) []string {
+	var names []string
+	varsSection := false
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			varsSection = strings.HasSuffix(line, ":vars]")
+			continue
+		}
+		if varsSection {
+			if i := strings.Index(line, "="); i > 0 {
+				names = append(names, strings.TrimSpace(line[:i]))
+			}
+			continue
+		}
+		for _, field := range strings.Fields(line)[1:] {
+			if i := strings.Index(field, "="); i > 0 {
+				names = append(names, field[:i])
+			}
+		}
+	}
+	return names
+}
+
+// hostGroupScope 返回主机所在组的权限范围
+func hostGroupScope(host Host) PermissionScope {
+	group := host.Group
+	if group == "" {
+		group = "ungrouped"
+	}
+	return PermissionScope{Groups: []string{group}}
+}
+
+// runScope 返回一次运行的权限范围; 主机组只取自服务端的 inventory 模板,
+// 请求中的 inventory 可以任意声明主机组, 因此只有不限 inventory 和主机组的权限才能使用
+func runScope(req AnsibleRequest) PermissionScope {
+	scope := PermissionScope{
+		Playbook:  req.PlaybookTemplate,
+		Inventory: req.InventoryTemplate,
+	}
+	if req.InventoryTemplate != "" {
+		scope.Groups = inventoryGroups(req.Inventory)
+	}
+	return scope
+}
+
+// authorizeRun 检查当前用户可以执行运行请求, 指定了 credential_id 时还需要该凭据的 use_credential 权限;
+// 设置 env 时还需要修改该 playbook 模板的权限
+func authorizeRun(w http.ResponseWriter, r *http.Request, req AnsibleRequest) bool {
+	if !authorize(w, r, ActionRun, runScope(req)) {
+		return false
+	}
+	if hasConnectionVars(req.Variables) && !authorize(w, r, ActionRun, unscopedRunScope(req)) {
+		return false
+	}
+	if len(req.Env) > 0 && !authorize(w, r, ActionEditTemplates, envScope(req)) {
+		return false
+	}
+	return req.CredentialID == 0 || authorize(w, r, ActionUseCredential, credentialScope(req))
+}
+
+// userCanRun 与 authorizeRun 相同, 用于没有请求的场景, 例如定时计划的所有者
+func userCanRun(user User, req AnsibleRequest) bool {
+	if !userCan(user, ActionRun, runScope(req)) {
+		return false
+	}
+	if hasConnectionVars(req.Variables) && !userCan(user, ActionRun, unscopedRunScope(req)) {
+		return false
+	}
+	if len(req.Env) > 0 && !userCan(user, ActionEditTemplates, envScope(req)) {
+		return false
+	}
+	return req.CredentialID == 0 || userCan(user, ActionUseCredential, credentialScope(req))
+}
+
+// unscopedRunScope 返回不指定 inventory 和主机组的运行范围, 只有不限 inventory 和主机组的权限才包含它;
+// 变量中的 ansible_host 等连接变量可以把运行指向范围以外的主机, 设置这些变量需要这样的权限
+func unscopedRunScope(req AnsibleRequest) PermissionScope {
+	return PermissionScope{Playbook: req.PlaybookTemplate}
+}
+
+// hasConnectionVars 判断变量中是否包含连接变量
+func hasConnectionVars(variables map[string]interface{}) bool {
+	for name := range variables {
+		if isConnectionVar(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// envScope 返回运行请求设置环境变量的权限范围; 环境变量可以改变 ansible 在控制节点上的行为,
+// 与能修改 playbook 模板的用户同等, 未使用 playbook 模板时需要不限范围的 edit_templates 权限
+func envScope(req AnsibleRequest) PermissionScope {
+	return PermissionScope{Playbook: req.PlaybookTemplate}
+}
+
+// credentialScope 返回运行请求使用运行级凭据的权限范围
+func credentialScope(req AnsibleRequest) PermissionScope {
+	scope := runScope(req)
+	scope.Credential = credentialName(req.CredentialID)
+	return scope
+}
+
+// templateScope 返回模板的权限范围
+func templateScope(template PlaybookTemplate) PermissionScope {
+	if template.Type == "inventory" {
+		return PermissionScope{Inventory: template.Name}
+	}
+	return PermissionScope{Playbook: template.Name}
+}
+
+// findTemplate 按类型和名称查找模板
+func findTemplate(templateType, name string) (PlaybookTemplate, bool) {
+	templatesMutex.Lock()
+	defer templatesMutex.Unlock()
+
+	for _, template := range templates {
+		if template.Type == templateType && template.Name == name {
+			return template, true
+		}
+	}
+	return PlaybookTemplate{}, false
+}
+
+// resolveRunTemplates 使用服务端保存的模板内容替换请求中的内容,
+// 避免以允许的模板名称提交其他内容
+func resolveRunTemplates(req *AnsibleRequest) error {
+	if req.PlaybookTemplate != "" {
+		template, ok := findTemplate("playbook", req.PlaybookTemplate)
+		if !ok {
+			return fmt.Errorf("playbook template %q not found", req.PlaybookTemplate)
+		}
+		req.Playbook = template.Content
+	}
+	if req.InventoryTemplate != "" {
+		template, ok := findTemplate("inventory", req.InventoryTemplate)
+		if !ok {
+			return fmt.Errorf("inventory template %q not found", req.InventoryTemplate)
+		}
+		req.Inventory = template.Content
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		value    string
+		want     bool
+	}{
+		{[]string{"web"}, "web", true},
+		{[]string{"web"}, "webservers", false},
+		{[]string{"web*"}, "webservers", true},
+		{[]string{"web*"}, "db", false},
+		{[]string{"db", "web?"}, "web1", true},
+		{[]string{"web?"}, "web10", false},
+		{[]string{"prod-[a-c]"}, "prod-b", true},
+		{[]string{"prod-[a-c]"}, "prod-d", false},
+		{[]string{"*"}, "anything", true},
+		{[]string{"*"}, "a/b", false},
+		{[]string{"[invalid"}, "[invalid", false},
+		{nil, "web", false},
+	}
+	for _, tt := range tests {
+		if got := matchPatterns(tt.patterns, tt.value); got != tt.want {
+			t.Errorf("matchPatterns(%q, %q) = %v, want %v", tt.patterns, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestPermissionCovers(t *testing.T) {
+	tests := []struct {
+		name       string
+		permission Permission
+		scope      PermissionScope
+		want       bool
+	}{
+		{"unscoped", Permission{Action: ActionRun}, PermissionScope{}, true},
+		{"unscoped with scope", Permission{Action: ActionRun}, PermissionScope{Playbook: "site", Groups: []string{"db"}}, true},
+
+		{"playbook glob", Permission{Playbooks: []string{"deploy-*"}}, PermissionScope{Playbook: "deploy-web"}, true},
+		{"playbook glob mismatch", Permission{Playbooks: []string{"deploy-*"}}, PermissionScope{Playbook: "site"}, false},
+		{"playbook pattern with extension", Permission{Playbooks: []string{"site.yml"}}, PermissionScope{Playbook: "site"}, true},
+		{"playbook glob with extension", Permission{Playbooks: []string{"deploy-*.yaml"}}, PermissionScope{Playbook: "deploy-db"}, true},
+		{"playbook scope without template", Permission{Playbooks: []string{"*"}}, PermissionScope{}, false},
+
+		{"inventory pattern with extension", Permission{Inventories: []string{"staging.ini"}}, PermissionScope{Inventory: "staging"}, true},
+		{"inventory mismatch", Permission{Inventories: []string{"staging*"}}, PermissionScope{Inventory: "production"}, false},
+		{"inventory scope without template", Permission{Inventories: []string{"*"}}, PermissionScope{Playbook: "site"}, false},
+
+		{"group", Permission{Groups: []string{"web*"}}, PermissionScope{Groups: []string{"webservers"}}, true},
+		{"every group covered", Permission{Groups: []string{"web*", "cache"}}, PermissionScope{Groups: []string{"web1", "cache"}}, true},
+		{"one group outside scope", Permission{Groups: []string{"web*"}}, PermissionScope{Groups: []string{"web1", "db"}}, false},
+		{"no groups in scope", Permission{Groups: []string{"web*"}}, PermissionScope{Playbook: "site"}, false},
+		{"empty group list in scope", Permission{Groups: []string{"*"}}, PermissionScope{Groups: []string{}}, false},
+
+		{"credential", Permission{Credentials: []string{"deploy-*"}}, PermissionScope{Credential: "deploy-key"}, true},
+		{"credential mismatch", Permission{Credentials: []string{"deploy-*"}}, PermissionScope{Credential: "root"}, false},
+		{"credential scope without credential", Permission{Credentials: []string{"*"}}, PermissionScope{}, false},
+
+		{
+			"all dimensions",
+			Permission{Playbooks: []string{"deploy"}, Inventories: []string{"prod"}, Groups: []string{"web"}},
+			PermissionScope{Playbook: "deploy", Inventory: "prod", Groups: []string{"web"}},
+			true,
+		},
+		{
+			"one dimension outside scope",
+			Permission{Playbooks: []string{"deploy"}, Inventories: []string{"prod"}, Groups: []string{"web"}},
+			PermissionScope{Playbook: "deploy", Inventory: "staging", Groups: []string{"web"}},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.permission.covers(tt.scope); got != tt.want {
+				t.Errorf("covers(%+v) = %v, want %v", tt.scope, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserCanGroupScopedRun(t *testing.T) {
+	scoped := User{
+		Role:        UserRoleViewer,
+		Permissions: []Permission{{Action: ActionRun, Inventories: []string{"prod"}, Groups: []string{"web*"}}},
+	}
+	admin := User{Role: UserRoleAdmin}
+	operator := User{Role: UserRoleOperator}
+
+	tests := []struct {
+		name string
+		user User
+		req  AnsibleRequest
+		want bool
+	}{
+		{"groups in scope", scoped, AnsibleRequest{InventoryTemplate: "prod", Inventory: "[web1]\nhost1\n\n[web2]\nhost2\n"}, true},
+		{"one group outside scope", scoped, AnsibleRequest{InventoryTemplate: "prod", Inventory: "[web1]\nhost1\n\n[db]\nhost2\n"}, false},
+		{"inventory outside scope", scoped, AnsibleRequest{InventoryTemplate: "staging", Inventory: "[web1]\nhost1\n"}, false},
+		{"raw inventory", scoped, AnsibleRequest{Inventory: "[web1]\nhost1\n"}, false},
+		{"inventory without groups", scoped, AnsibleRequest{InventoryTemplate: "prod", Inventory: "host1\n"}, false},
+		{"operator", operator, AnsibleRequest{Inventory: "[db]\nhost1\n"}, true},
+		{"admin", admin, AnsibleRequest{InventoryTemplate: "staging", Inventory: "[db]\nhost1\n"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := userCan(tt.user, ActionRun, runScope(tt.req)); got != tt.want {
+				t.Errorf("userCan(run, %+v) = %v, want %v", runScope(tt.req), got, tt.want)
+			}
+		})
+	}
+
+	// 带范围的权限只适用于对应的操作
+	if userCan(scoped, ActionEditTemplates, PermissionScope{Inventory: "prod", Groups: []string{"web1"}}) {
+		t.Error("run permission grants edit_templates")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	REDACTION_CONFIG_FILE = "/redaction.json" // 脱敏配置文件, 不存在时使用默认配置
+
+	defaultRedactionMask = "********"
+
+	// 过短的机密值不做全文替换, 否则会破坏正常输出
+	minRedactValueLength = 4
+)
+
+// RedactionConfig 是每个部署可单独配置的脱敏规则
+type RedactionConfig struct {
+	Disabled bool     `json:"disabled"`
+	Mask     string   `json:"mask"`
+	Keys     []string `json:"keys"`     // 额外需要隐藏值的变量名, 匹配 key=value 和 key: value
+	Patterns []string `json:"patterns"` // 额外需要隐藏的正则表达式
+}
+
+// 默认隐藏值的连接相关变量
+var defaultRedactKeys = []string{
+	"ansible_password",
+	"ansible_ssh_pass",
+	"ansible_ssh_password",
+	"ansible_become_pass",
+	"ansible_become_password",
+	"ansible_sudo_pass",
+	"ansible_su_pass",
+	"ansible_ssh_private_key_passphrase",
+	"vault_password",
+}
+
+var privateKeyBlockPattern = regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----.*?-----END [A-Z0-9 ]*PRIVATE KEY-----`)
+var privateKeyBeginPattern = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----`)
+var privateKeyEndPattern = regexp.MustCompile(`-----END [A-Z0-9 ]*PRIVATE KEY-----`)
+
+// Redactor 隐藏文本中的机密值和敏感模式
+type Redactor struct {
+	disabled bool
+	mask     string
+	keys     *regexp.Regexp
+	patterns []*regexp.Regexp
+	values   []string
+}
+
+// LineRedactor 用于逐行输出的一个流, 会跨行记住私钥块的开始和结束
+type LineRedactor struct {
+	*Redactor
+	inKey bool
+}
+
+var (
+	redactionConfig RedactionConfig
+	baseRedactor    = newRedactor(RedactionConfig{}, nil)
+)
+
+// loadRedactionConfig 加载脱敏配置, 配置中的正则表达式无效时启动失败
+func loadRedactionConfig() error {
+	path := filepath.Join(DATA_DIR, REDACTION_CONFIG_FILE)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &redactionConfig); err != nil {
+			return fmt.Errorf("invalid redaction config %s: %v", path, err)
+		}
+	}
+	for _, pattern := range redactionConfig.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid redaction pattern %q: %v", pattern, err)
+		}
+	}
+	if redactionConfig.Disabled {
+		fmt.Printf("[Go] 警告: 输出脱敏已关闭\n")
+	}
+	baseRedactor = newRedactor(redactionConfig, nil)
+	return nil
+}
+
+func newRedactor(config RedactionConfig, values []string) *Redactor {
+	r := &Redactor{
+		disabled: config.Disabled,
+		mask:     config.Mask,
+	}
+	if r.mask == "" {
+		r.mask = defaultRedactionMask
+	}
+
+	keys := append(append([]string{}, defaultRedactKeys...), config.Keys...)
+	for i := range keys {
+		keys[i] = regexp.QuoteMeta(keys[i])
+	}
+	// 匹配 key=value, key: value 以及 JSON 中的 "key": "value"
+	r.keys = regexp.MustCompile(`(?i)(["']?\b(?:` + strings.Join(keys, "|") + `)\b["']?\s*[=:]\s*)("(?:[^"\\]|\\.)*"|'[^']*'|[^\s,}]+)`)
+
+	for _, pattern := range config.Patterns {
+		if re, err := regexp.Compile(pattern); err == nil {
+			r.patterns = append(r.patterns, re)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, value := range values {
+		if len(value) < minRedactValueLength {
+			continue
+		}
+		// ansible 以 JSON 输出结果, 含引号、反斜杠或控制字符的值会以转义形式出现
+		for _, form := range []string{value, jsonEscaped(value)} {
+			if !seen[form] {
+				seen[form] = true
+				r.values = append(r.values, form)
+			}
+		}
+	}
+	// 先替换较长的值, 避免较短的值先替换后留下部分内容
+	sort.Slice(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+	return r
+}
+
+// jsonEscaped 返回值在 JSON 字符串中的形式, 不含两侧的引号
+func jsonEscaped(value string) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return value
+	}
+	encoded := strings.TrimSuffix(buf.String(), "\n")
+	return encoded[1 : len(encoded)-1]
+}
+
+// newRunRedactor 创建一次运行使用的脱敏器, 包含所有已保存机密和凭据的值以及 extra 中的值 (如调查表中的密码)
+func newRunRedactor(extra ...string) (*Redactor, error) {
+	values, err := knownSecretValues()
+	if err != nil {
+		return nil, err
+	}
+	return newRedactor(redactionConfig, append(values, extra...)), nil
+}
+
+// knownSecretValues 解密所有机密和凭据, 返回其中的值
+func knownSecretValues() ([]string, error) {
+	var values []string
+
+	secretsMutex.Lock()
+	for _, secret := range secrets {
+		value, err := decryptSecretValue(secret.Name, secret.Ciphertext)
+		if err != nil {
+			secretsMutex.Unlock()
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	secretsMutex.Unlock()
+
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+	for _, credential := range credentials {
+		plain, err := decryptCredential(credential)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, plain.Password, plain.Passphrase, plain.BecomePassword)
+		// 私钥按行加入, 单独输出的某一行也能被隐藏
+		for _, line := range strings.Split(plain.PrivateKey, "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "-----") {
+				values = append(values, line)
+			}
+		}
+	}
+	return values, nil
+}
+
+// Redact 隐藏一段完整文本中的机密
+func (r *Redactor) Redact(text string) string {
+	if r.disabled || text == "" {
+		return text
+	}
+	text = privateKeyBlockPattern.ReplaceAllString(text, r.mask)
+	return r.redactInline(text)
+}
+
+// Lines 为一个输出流创建逐行脱敏器, 每个流需要单独创建
+func (r *Redactor) Lines() *LineRedactor {
+	return &LineRedactor{Redactor: r}
+}
+
+// RedactLine 隐藏一行输出中的机密
+func (r *LineRedactor) RedactLine(line string) string {
+	if r.disabled {
+		return line
+	}
+
+	if r.inKey {
+		if loc := privateKeyEndPattern.FindStringIndex(line); loc != nil {
+			r.inKey = false
+			return r.mask + r.redactInline(line[loc[1]:])
+		}
+		return r.mask
+	}
+
+	line = privateKeyBlockPattern.ReplaceAllString(line, r.mask)
+	if loc := privateKeyBeginPattern.FindStringIndex(line); loc != nil {
+		r.inKey = true
+		return r.redactInline(line[:loc[0]]) + r.mask
+	}
+	return r.redactInline(line)
+}
+
+func (r *Redactor) redactInline(text string) string {
+	for _, value := range r.values {
+		text = strings.Replace(text, value, r.mask, -1)
+	}
+	text = r.keys.ReplaceAllString(text, "${1}"+r.mask)
+	for _, re := range r.patterns {
+		text = re.ReplaceAllString(text, r.mask)
+	}
+	return text
+}
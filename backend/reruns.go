@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const TASK_REQUEST_DIR = "/task_requests" // 任务的原始运行请求, 用于重新运行和克隆; 使用主密钥加密
+
+// HostResult 是 PLAY RECAP 中一台主机的统计
+type HostResult struct {
+	Host        string `json:"host"`
+	Ok          int    `json:"ok"`
+	Changed     int    `json:"changed"`
+	Unreachable int    `json:"unreachable"`
+	Failed      int    `json:"failed"`
+	Skipped     int    `json:"skipped"`
+	Rescued     int    `json:"rescued"`
+	Ignored     int    `json:"ignored"`
+}
+
+// recapPattern 匹配 "web1 : ok=2 changed=1 unreachable=0 failed=1 skipped=0 rescued=0 ignored=0"
+var recapPattern = regexp.MustCompile(`^(\S+)\s+:\s+((?:[a-z]+=\d+\s*)+)$`)
+
+// parseRecap 从运行输出的 PLAY RECAP 中解析每台主机的结果
+func parseRecap(output string) []HostResult {
+	var results []HostResult
+	inRecap := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "PLAY RECAP") {
+			inRecap = true
+			results = nil // 只保留最后一个 PLAY RECAP
+			continue
+		}
+		if !inRecap {
+			continue
+		}
+		m := recapPattern.FindStringSubmatch(line)
+		if m == nil {
+			if line != "" {
+				inRecap = false
+			}
+			continue
+		}
+		result := HostResult{Host: m[1]}
+		for _, field := range strings.Fields(m[2]) {
+			kv := strings.SplitN(field, "=", 2)
+			n, _ := strconv.Atoi(kv[1])
+			switch kv[0] {
+			case "ok":
+				result.Ok = n
+			case "changed":
+				result.Changed = n
+			case "unreachable":
+				result.Unreachable = n
+			case "failed":
+				result.Failed = n
+			case "skipped":
+				result.Skipped = n
+			case "rescued":
+				result.Rescued = n
+			case "ignored":
+				result.Ignored = n
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// failedHosts 返回任务中失败或不可达的主机
+func failedHosts(task Task) []string {
+	var hosts []string
+	for _, result := range task.HostResults {
+		if result.Failed > 0 || result.Unreachable > 0 {
+			hosts = append(hosts, result.Host)
+		}
+	}
+	return hosts
+}
+
+func taskRequestPath(id int) string {
+	return filepath.Join(DATA_DIR, TASK_REQUEST_DIR, fmt.Sprintf("%d.json", id))
+}
+
+// taskRequestName 是加密任务请求时的附加数据, 防止把一个任务的请求挪给另一个任务
+func taskRequestName(taskID int) string {
+	return fmt.Sprintf("task_request/%d", taskID)
+}
+
+// saveTaskRequest 保存任务的运行请求 (模板已展开); 请求中可能有调查表密码、环境变量等值,
+// 使用主密钥加密后写入, 文件权限为 0600
+func saveTaskRequest(taskID int, req AnsibleRequest) error {
+	path := taskRequestPath(taskID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	sealed, err := encryptSecretValue(taskRequestName(taskID), string(data))
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(sealed), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadTaskRequest(taskID int) (AnsibleRequest, error) {
+	var req AnsibleRequest
+	data, err := ioutil.ReadFile(taskRequestPath(taskID))
+	if err != nil {
+		return req, err
+	}
+	plain, err := decryptSecretValue(taskRequestName(taskID), string(data))
+	if err != nil {
+		return req, err
+	}
+	err = json.Unmarshal([]byte(plain), &req)
+	return req, err
+}
+
+// taskAction 是 /tasks/{id}/<action> 形式的任务操作
+type taskAction struct {
+	method  string
+	handler func(w http.ResponseWriter, r *http.Request, id int)
+}
+
+var taskActions = map[string]taskAction{
+	"rerun":        {http.MethodPost, rerunTaskHandler(false)},
+	"retry-failed": {http.MethodPost, rerunTaskHandler(true)},
+	"clone":        {http.MethodGet, cloneTaskHandler},
+}
+
+// taskActionHandler 处理 /tasks/ 下的 /tasks/{id}/rerun、/tasks/{id}/retry-failed 和 /tasks/{id}/clone;
+// 在处理函数中解析路径, 不依赖 Go 1.22 的路由通配
+func taskActionHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/tasks/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	action, ok := taskActions[parts[1]]
+	if err != nil || id <= 0 || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != action.method && !(action.method == http.MethodGet && r.Method == http.MethodHead) {
+		w.Header().Set("Allow", action.method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	action.handler(w, r, id)
+}
+
+// finishedTaskRequest 读取已结束任务的运行请求并检查当前用户可以执行, 失败时写入响应
+func finishedTaskRequest(w http.ResponseWriter, r *http.Request, id int) (Task, AnsibleRequest, bool) {
+	task, ok := findTask(id)
+	if !ok {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return Task{}, AnsibleRequest{}, false
+	}
+	if !taskFinished(task.Status) {
+		http.Error(w, "Task has not finished", http.StatusConflict)
+		return Task{}, AnsibleRequest{}, false
+	}
+	req, err := loadTaskRequest(id)
+	if err != nil {
+		fmt.Printf("[Go] 读取任务 #%d 的运行请求失败: %v\n", id, err)
+		http.Error(w, "The original run request of this task is not available", http.StatusConflict)
+		return Task{}, AnsibleRequest{}, false
+	}
+	if !authorizeRun(w, r, req) {
+		return Task{}, AnsibleRequest{}, false
+	}
+	return task, req, true
+}
+
+// rerunTaskHandler 以原任务的输入重新运行; onlyFailed 时只在原任务失败或不可达的主机上运行
+func rerunTaskHandler(onlyFailed bool) func(w http.ResponseWriter, r *http.Request, id int) {
+	return func(w http.ResponseWriter, r *http.Request, id int) {
+		action := "task.rerun"
+		if onlyFailed {
+			action = "task.retry-failed"
+		}
+
+		parent, req, ok := finishedTaskRequest(w, r, id)
+		if !ok {
+			return
+		}
+		if onlyFailed {
+			hosts := failedHosts(parent)
+			if len(hosts) == 0 {
+				http.Error(w, "Task has no failed or unreachable hosts", http.StatusConflict)
+				return
+			}
+			req.Limit = strings.Join(hosts, ",")
+		}
+
+		if !beginRun() {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		run, err := prepareRun(req)
+		if err != nil {
+			endRun()
+			fmt.Printf("[Go] 准备运行失败: %v\n", err)
+			if isRunRequestError(err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		user, _ := currentUser(r)
+		apiToken, _ := currentToken(r)
+		task := newRunTask(req, run, user, apiToken)
+		task.ParentTaskID = parent.ID
+		task = createTask(task)
+		fmt.Printf("[Go] 用户 %s 重新运行任务 #%d, 新任务 #%d\n", user.Username, parent.ID, task.ID)
+		recordAudit(r, action, fmt.Sprintf("task/%d", task.ID), nil, task)
+
+		go func() {
+			defer endRun()
+			defer run.cleanup()
+			dispatchRun(task.ID, req, run, nil)
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(task)
+	}
+}
+
+// cloneTaskHandler 返回已结束任务的运行请求, 供修改后通过 /run 或 /adhoc 重新提交;
+// 调查表中 password 类型的值和环境变量的值可能是其他用户设置的机密, 不返回, 需要重新填写
+func cloneTaskHandler(w http.ResponseWriter, r *http.Request, id int) {
+	_, req, ok := finishedTaskRequest(w, r, id)
+	if !ok {
+		return
+	}
+	if req.PlaybookTemplate != "" {
+		if template, ok := findTemplate("playbook", req.PlaybookTemplate); ok {
+			for _, field := range template.Survey {
+				if field.Type == SurveyTypePassword {
+					delete(req.Variables, field.Name)
+				}
+			}
+		}
+	}
+	req.Env = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxRunVerbosity = 4   // -vvvv
+	maxRunForks     = 500 // 避免一次运行占满控制节点
+
+	// serial 是 play 关键字, 没有对应的命令行参数, 以此名称作为 extra var 传入,
+	// playbook 中写 serial: "{{ run_serial | default(0) }}" 即可被覆盖
+	runSerialVar = "run_serial"
+)
+
+// RunOptions 是运行请求中可以设置的 ansible-playbook 选项, 同时记录在任务中用于重现运行;
+// 不支持 --step 等需要交互的选项, serial 通过 run_serial 变量传给 playbook
+type RunOptions struct {
+	Limit       string   `json:"limit,omitempty"`         // --limit, 主机模式
+	Tags        []string `json:"tags,omitempty"`          // --tags
+	SkipTags    []string `json:"skip_tags,omitempty"`     // --skip-tags
+	StartAtTask string   `json:"start_at_task,omitempty"` // --start-at-task
+	Check       bool     `json:"check,omitempty"`         // --check
+	Diff        bool     `json:"diff,omitempty"`          // --diff
+	Verbosity   int      `json:"verbosity,omitempty"`     // -v 的个数, 0-4
+	Forks       int      `json:"forks,omitempty"`         // --forks, 0 表示使用 ansible 的默认值
+	Become      bool     `json:"become,omitempty"`        // --become
+	BecomeUser  string   `json:"become_user,omitempty"`   // --become-user, 需要同时设置 become
+	Serial      string   `json:"serial,omitempty"`        // 每批主机数, 如 "2"、"25%" 或 "1,5,20%", 见 runSerialVar
+}
+
+var (
+	// 主机模式允许 all、web*、web:&prod、!db、web[0:2] 等写法, 不允许 @文件
+	limitPattern      = regexp.MustCompile(`^[A-Za-z0-9_.*?:!&,~\[\]\-]+$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.:-]*$`)
+	becomeUserPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+	serialPattern     = regexp.MustCompile(`^([1-9][0-9]*)(%?)$`)
+)
+
+// validate 检查运行选项, 所有值都作为独立参数传递, 这里主要拒绝会被当作其他选项或文件的值
+func (o RunOptions) validate() error {
+	if o.Limit != "" && (strings.HasPrefix(o.Limit, "-") || !limitPattern.MatchString(o.Limit)) {
+		return fmt.Errorf("invalid limit %q", o.Limit)
+	}
+	for _, tag := range append(append([]string{}, o.Tags...), o.SkipTags...) {
+		if !tagPattern.MatchString(tag) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	if o.StartAtTask != "" && (strings.HasPrefix(o.StartAtTask, "-") || strings.ContainsAny(o.StartAtTask, "\r\n") || len(o.StartAtTask) > 256) {
+		return fmt.Errorf("invalid start_at_task %q", o.StartAtTask)
+	}
+	if o.Verbosity < 0 || o.Verbosity > maxRunVerbosity {
+		return fmt.Errorf("verbosity must be between 0 and %d", maxRunVerbosity)
+	}
+	if o.Forks < 0 || o.Forks > maxRunForks {
+		return fmt.Errorf("forks must be between 0 and %d", maxRunForks)
+	}
+	if _, err := o.serialValue(); err != nil {
+		return err
+	}
+	if o.BecomeUser != "" {
+		if !o.Become {
+			return fmt.Errorf("become_user requires become")
+		}
+		if !becomeUserPattern.MatchString(o.BecomeUser) {
+			return fmt.Errorf("invalid become_user %q", o.BecomeUser)
+		}
+	}
+	return nil
+}
+
+// serialValue 解析 serial, 返回传给 playbook 的值: 单个批次为数字或百分比字符串, 多个批次为列表;
+// 百分比不能超过 100%
+func (o RunOptions) serialValue() (interface{}, error) {
+	if o.Serial == "" {
+		return nil, nil
+	}
+	var batches []interface{}
+	for _, item := range strings.Split(o.Serial, ",") {
+		m := serialPattern.FindStringSubmatch(strings.TrimSpace(item))
+		if m == nil {
+			return nil, fmt.Errorf("invalid serial %q", o.Serial)
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil || m[2] == "%" && n > 100 {
+			return nil, fmt.Errorf("invalid serial %q", o.Serial)
+		}
+		if m[2] == "%" {
+			batches = append(batches, m[1]+"%")
+		} else {
+			batches = append(batches, n)
+		}
+	}
+	if len(batches) == 1 {
+		return batches[0], nil
+	}
+	return batches, nil
+}
+
+// args 返回对应的 ansible-playbook 参数
+func (o RunOptions) args() []string {
+	var args []string
+	if o.Limit != "" {
+		args = append(args, "--limit", o.Limit)
+	}
+	if len(o.Tags) > 0 {
+		args = append(args, "--tags", strings.Join(o.Tags, ","))
+	}
+	if len(o.SkipTags) > 0 {
+		args = append(args, "--skip-tags", strings.Join(o.SkipTags, ","))
+	}
+	if o.StartAtTask != "" {
+		args = append(args, "--start-at-task", o.StartAtTask)
+	}
+	if o.Check {
+		args = append(args, "--check")
+	}
+	if o.Diff {
+		args = append(args, "--diff")
+	}
+	if o.Verbosity > 0 {
+		args = append(args, "-"+strings.Repeat("v", o.Verbosity))
+	}
+	if o.Forks > 0 {
+		args = append(args, "--forks", strconv.Itoa(o.Forks))
+	}
+	if o.Become {
+		args = append(args, "--become")
+	}
+	if o.BecomeUser != "" {
+		args = append(args, "--become-user", o.BecomeUser)
+	}
+	return args
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// runSink 接收一次运行中已脱敏的逐行输出
+type runSink func(line string, isError bool)
+
+// runRequestError 表示运行请求本身有问题 (例如引用了不存在的机密), 应返回 400
+type runRequestError struct {
+	err error
+}
+
+func (e runRequestError) Error() string { return e.err.Error() }
+
+// preparedRun 是已准备好的运行目录, 包含 playbook、inventory、机密、凭据和文件
+type preparedRun struct {
+	Dir               string
+	PlaybookFile      string
+	InventoryFile     string
+	SecretNames       []string
+	Locks             []string      // 执行期间独占的 inventory 和主机组
+	Adhoc             *AdhocCommand // 设置后执行 ansible ad-hoc 命令, 不使用 PlaybookFile
+	Timeout           time.Duration // 运行的最长时间, 0 表示不限制
+	InactivityTimeout time.Duration // 没有输出的最长时间, 0 表示不限制
+	AnsiblePlaybook   string        // 执行环境中的 ansible-playbook
+	Ansible           string        // 执行环境中的 ansible, 用于 ad-hoc 命令
+	Env               []string      // 执行环境追加的环境变量
+	Environment       RunEnvironment
+	Redactor          *Redactor
+	args              []string
+	blobs             []string // 链接到 files/ 的内容, cleanup 时释放
+}
+
+// prepareRun 创建临时目录并写入一次运行需要的所有文件, 调用方需要调用 cleanup
+func prepareRun(req AnsibleRequest) (*preparedRun, error) {
+	if err := req.RunOptions.validate(); err != nil {
+		return nil, runRequestError{err}
+	}
+	if req.Adhoc != nil {
+		if err := req.Adhoc.validate(); err != nil {
+			return nil, runRequestError{err}
+		}
+		if !moduleAllowed(req.Adhoc.Module) {
+			return nil, runRequestError{fmt.Errorf("module %q is not allowed", req.Adhoc.Module)}
+		}
+	}
+	// 请求中的 inventory 由请求方决定主机和地址, 运行级凭据只能用于 inventory 模板
+	if req.CredentialID != 0 && req.InventoryTemplate == "" {
+		return nil, runRequestError{fmt.Errorf("credential_id requires an inventory_template")}
+	}
+	timeout, inactivityTimeout, err := runTimeouts(req)
+	if err != nil {
+		return nil, runRequestError{err}
+	}
+	// 按模板的调查表检查变量并补充默认值, password 类型的值需要从输出中隐藏
+	passwords, err := applySurvey(&req)
+	if err != nil {
+		return nil, runRequestError{err}
+	}
+	environment, err := runEnvironment(req)
+	if err != nil {
+		return nil, runRequestError{err}
+	}
+	if err := validateRunEnv(req.Env); err != nil {
+		return nil, runRequestError{err}
+	}
+	ansibleConfig, err := runAnsibleConfig(req, environment)
+	if err != nil {
+		return nil, runRequestError{err}
+	}
+
+	tmpDir, err := ioutil.TempDir(serverConfig.TempDir, "ansible-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	run := &preparedRun{
+		Dir:               tmpDir,
+		PlaybookFile:      filepath.Join(tmpDir, "playbook.yml"),
+		InventoryFile:     filepath.Join(tmpDir, "inventory.ini"),
+		Timeout:           timeout,
+		InactivityTimeout: inactivityTimeout,
+		Adhoc:             req.Adhoc,
+		AnsiblePlaybook:   serverConfig.AnsiblePlaybook,
+		Ansible:           serverConfig.Ansible,
+	}
+	if environment != nil {
+		run.AnsiblePlaybook, run.Ansible = environment.binaries()
+		run.Env = environment.env()
+		run.Environment = RunEnvironment{ExecutionEnvironment: environment.Name, AnsibleVersion: environment.Version}
+	}
+
+	if err := ioutil.WriteFile(run.PlaybookFile, []byte(req.Playbook), 0644); err != nil {
+		run.cleanup()
+		return nil, fmt.Errorf("failed to save playbook file: %v", err)
+	}
+	if err := ioutil.WriteFile(run.InventoryFile, []byte(req.Inventory), 0644); err != nil {
+		run.cleanup()
+		return nil, fmt.Errorf("failed to save inventory file: %v", err)
+	}
+
+	// 请求中的变量作为 extra vars 传给 ansible-playbook, serial 以 run_serial 变量传入
+	variables := req.Variables
+	if serial, _ := req.RunOptions.serialValue(); serial != nil && req.Adhoc == nil {
+		variables = make(map[string]interface{}, len(req.Variables)+1)
+		for name, value := range req.Variables {
+			variables[name] = value
+		}
+		variables[runSerialVar] = serial
+	}
+	var varsArgs []string
+	if len(variables) > 0 {
+		data, err := json.Marshal(variables)
+		if err != nil {
+			run.cleanup()
+			return nil, runRequestError{fmt.Errorf("invalid variables: %v", err)}
+		}
+		varsFile := filepath.Join(tmpDir, "extra_vars.json")
+		if err := ioutil.WriteFile(varsFile, data, 0600); err != nil {
+			run.cleanup()
+			return nil, fmt.Errorf("failed to save variables: %v", err)
+		}
+		varsArgs = []string{"-e", "@" + varsFile}
+	}
+
+	// 注入请求指定的以及 inventory 中以 {{ name }} 引用的机密
+	run.SecretNames = append(append([]string{}, req.Secrets...), referencedSecrets(req.Inventory)...)
+	secretArgs, err := prepareRunSecrets(tmpDir, run.SecretNames)
+	if err != nil {
+		run.cleanup()
+		return nil, runRequestError{fmt.Errorf("failed to prepare secrets: %v", err)}
+	}
+
+	// 写入主机、主机组和本次运行指定的连接凭据
+	credentialArgs, err := prepareRunCredentials(tmpDir, req)
+	if err != nil {
+		run.cleanup()
+		return nil, runRequestError{fmt.Errorf("failed to prepare credentials: %v", err)}
+	}
+
+	// 将 playbook 引用的文件放到 files/ 目录供 copy:/unarchive: 使用
+	if err := stageRunFiles(run, runFileReferences(req)); err != nil {
+		run.cleanup()
+		return nil, fmt.Errorf("failed to stage files: %v", err)
+	}
+
+	// playbook 中 set_stats 设置的数据记录为任务的 artifacts, 供工作流传给后续节点
+	if req.Adhoc == nil {
+		if err := prepareRunArtifacts(tmpDir); err != nil {
+			run.cleanup()
+			return nil, fmt.Errorf("failed to prepare artifacts: %v", err)
+		}
+	}
+
+	// 终端日志、SSE 输出和任务记录中的机密都需要隐藏
+	if run.Redactor, err = newRunRedactor(passwords...); err != nil {
+		run.cleanup()
+		return nil, fmt.Errorf("failed to prepare output redaction: %v", err)
+	}
+
+	// 受管的 ansible.cfg 写入运行目录并通过 ANSIBLE_CONFIG 指定, 请求中的环境变量最后设置;
+	// 两者都记录在任务中
+	if ansibleConfig != nil {
+		content := ansibleConfig.render()
+		cfgFile := filepath.Join(tmpDir, runAnsibleCfgFile)
+		if err := ioutil.WriteFile(cfgFile, []byte(content), 0600); err != nil {
+			run.cleanup()
+			return nil, fmt.Errorf("failed to save ansible.cfg: %v", err)
+		}
+		run.Env = append(run.Env, "ANSIBLE_CONFIG="+cfgFile)
+		run.Environment.AnsibleConfig = run.Redactor.Redact(content)
+	}
+	for name, value := range req.Env {
+		run.Env = append(run.Env, name+"="+value)
+		if run.Environment.Env == nil {
+			run.Environment.Env = map[string]string{}
+		}
+		run.Environment.Env[name] = run.Redactor.Redact(value)
+	}
+
+	run.args = append([]string{"-i", run.InventoryFile}, secretArgs...)
+	run.args = append(run.args, credentialArgs...)
+	run.args = append(run.args, runVaultArgs(tmpDir)...)
+	run.args = append(run.args, varsArgs...)
+	run.args = append(run.args, req.RunOptions.args()...)
+	run.Locks = runLocks(req.InventoryTemplate, inventoryGroups(req.Inventory))
+	return run, nil
+}
+
+// cleanup 擦除凭据文件、删除临时目录并释放运行期间保留的文件内容
+func (p *preparedRun) cleanup() {
+	wipeRunCredentials(p.Dir)
+	os.RemoveAll(p.Dir)
+	releaseRunFiles(p)
+}
+
+// run 执行 ansible-playbook, extraArgs 放在 playbook 之前 (例如 --check --diff);
+// 输出逐行脱敏后回调 emit, 返回脱敏后的完整输出; 超时时返回的错误包装 errRunTimedOut
+func (p *preparedRun) run(extraArgs []string, emit runSink) (string, error) {
+	// 服务关闭或超时都会取消 ctx, 超时的原因记录在 cause 中
+	ctx, cancel := context.WithCancelCause(runsContext)
+	defer cancel(nil)
+	if p.Timeout > 0 {
+		timer := time.AfterFunc(p.Timeout, func() {
+			cancel(fmt.Errorf("%w: exceeded %v", errRunTimedOut, p.Timeout))
+		})
+		defer timer.Stop()
+	}
+	var idle *time.Timer
+	if p.InactivityTimeout > 0 {
+		idle = time.AfterFunc(p.InactivityTimeout, func() {
+			cancel(fmt.Errorf("%w: no output for %v", errRunTimedOut, p.InactivityTimeout))
+		})
+		defer idle.Stop()
+	}
+
+	binary, target := p.AnsiblePlaybook, []string{p.PlaybookFile}
+	if p.Adhoc != nil {
+		binary, target = p.Ansible, p.Adhoc.args()
+	}
+	args := append(append(append([]string{}, p.args...), extraArgs...), target...)
+	cmd := exec.CommandContext(ctx, binary, args...)
+	// ansible-playbook 会派生 ssh 等子进程, 放到单独的进程组中, 取消时结束整个进程组;
+	// 忽略 SIGTERM 的子进程会一直占用输出管道, 宽限时间后用 SIGKILL 结束
+	exited := make(chan struct{})
+	defer close(exited)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := -cmd.Process.Pid
+		go func() {
+			select {
+			case <-exited:
+			case <-time.After(cancelRunsGrace):
+				syscall.Kill(pgid, syscall.SIGKILL)
+			}
+		}()
+		return syscall.Kill(pgid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = cancelRunsGrace
+
+	// 设置工作目录为临时目录
+	cmd.Dir = p.Dir
+	// 使已导入的角色和集合对 playbook 可见, 执行环境和请求的设置在最后, 可以覆盖前面的值
+	cmd.Env = append(append(serverEnv(), galaxyEnv()...), p.Env...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", fmt.Errorf("failed to create stderr pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start command: %v", err)
+	}
+
+	// stdout 和 stderr 由两个 goroutine 读取, 回调和记录输出时需要加锁
+	var outputMutex sync.Mutex
+	var output strings.Builder
+	read := func(pipe *bufio.Scanner, isError bool, readers *sync.WaitGroup) {
+		defer readers.Done()
+		lines := p.Redactor.Lines()
+		for pipe.Scan() {
+			if idle != nil {
+				idle.Reset(p.InactivityTimeout)
+			}
+			line := lines.RedactLine(pipe.Text())
+			outputMutex.Lock()
+			output.WriteString(line)
+			output.WriteString("\n")
+			emit(line, isError)
+			outputMutex.Unlock()
+		}
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go read(bufio.NewScanner(stdout), false, &readers)
+	go read(bufio.NewScanner(stderr), true, &readers)
+
+	// 等待输出读取完毕后再等待命令完成
+	readers.Wait()
+	err = cmd.Wait()
+	if cause := context.Cause(ctx); err != nil && errors.Is(cause, errRunTimedOut) {
+		err = cause
+	}
+	return output.String(), err
+}
+
+// newRunTask 根据运行请求生成任务记录, playbook 和 inventory 内容已脱敏; 需要调用 createTask 保存
+func newRunTask(req AnsibleRequest, run *preparedRun, user User, token APIToken) Task {
+	kind, adhoc := TaskKindPlaybook, (*AdhocCommand)(nil)
+	if req.Adhoc != nil {
+		redacted := *req.Adhoc
+		redacted.Args = run.Redactor.Redact(redacted.Args)
+		kind, adhoc = TaskKindAdhoc, &redacted
+	}
+	return Task{
+		Kind:              kind,
+		Adhoc:             adhoc,
+		Playbook:          run.Redactor.Redact(req.Playbook),
+		Inventory:         run.Redactor.Redact(req.Inventory),
+		PlaybookTemplate:  req.PlaybookTemplate,
+		InventoryTemplate: req.InventoryTemplate,
+		Secrets:           run.SecretNames,
+		CredentialID:      req.CredentialID,
+		RunOptions:        req.RunOptions,
+		RunEnvironment:    run.Environment,
+		UserID:            user.ID,
+		Username:          user.Username,
+		TokenID:           token.ID,
+		TokenName:         token.Name,
+		Timeout:           Duration(run.Timeout),
+		InactivityTimeout: Duration(run.InactivityTimeout),
+		Status:            TaskStatusPending,
+		Progress:          0,
+		StartTime:         time.Now(),
+		Timestamp:         time.Now(),
+	}
+}
+
+// dispatchRun 对涉及受保护目标的运行生成预览并等待审批, 否则直接执行;
+// 返回任务是否进入等待审批状态
+func dispatchRun(taskID int, req AnsibleRequest, run *preparedRun, sink runSink) (bool, error) {
+	// 保存运行请求, 以便之后重新运行或重试失败的主机
+	if err := saveTaskRequest(taskID, req); err != nil {
+		fmt.Printf("[Go] 保存任务 #%d 的运行请求失败: %v\n", taskID, err)
+	}
+	if requiresApproval(req) {
+		requestApproval(taskID, req, run, sink)
+		return true, nil
+	}
+	return false, executeTask(taskID, run, sink)
+}
+
+// executeTask 执行已创建的任务, 输出记录到终端和任务日志, sink 不为空时同时转发;
+// 结束后更新任务状态并发送通知
+func executeTask(taskID int, p *preparedRun, sink runSink) error {
+	// 超过并发限制或目标被其他运行占用时保持 pending 排队
+	release, err := waitForRunSlot(taskID, p.Locks, sink)
+	if err != nil {
+		cancelTask(taskID, err)
+		return err
+	}
+	defer release()
+
+	updateTask(taskID, func(task *Task) {
+		task.Status = TaskStatusRunning
+	})
+	fmt.Printf("[Go] 任务 #%d 开始执行\n", taskID)
+
+	output, err := p.run(nil, func(line string, isError bool) {
+		level := "info"
+		if isError {
+			level = "error"
+			// Golang 日志输出到终端
+			fmt.Printf("[Ansible Error] %s\n", line)
+		} else {
+			fmt.Printf("[Ansible] %s\n", line)
+		}
+		addTaskLog(taskID, line, level)
+		if sink != nil {
+			sink(line, isError)
+		}
+	})
+
+	endTime := time.Now()
+	results := parseRecap(output)
+	artifacts := p.artifacts()
+	if err != nil && runsContext.Err() != nil {
+		cancelTask(taskID, fmt.Errorf("%sCanceled: server is shutting down", output))
+		return err
+	}
+	if errors.Is(err, errRunTimedOut) {
+		fmt.Printf("[Go] 任务 #%d 执行超时: %v\n", taskID, err)
+		updateTask(taskID, func(task *Task) {
+			task.Status = TaskStatusTimedOut
+			task.Output = output + err.Error()
+			task.HostResults = results
+			task.Artifacts = artifacts
+			task.EndTime = &endTime
+		})
+		addNotification(NotificationTypeError, fmt.Sprintf("任务 #%d 执行超时", taskID))
+		return err
+	}
+	if err != nil {
+		fmt.Printf("[Go] 任务 #%d 执行失败: %v\n", taskID, err)
+		updateTask(taskID, func(task *Task) {
+			task.Status = TaskStatusFailed
+			task.Output = output + err.Error()
+			task.HostResults = results
+			task.Artifacts = artifacts
+			task.EndTime = &endTime
+		})
+		addNotification(NotificationTypeError, fmt.Sprintf("任务 #%d 执行失败", taskID))
+		return err
+	}
+
+	fmt.Printf("[Go] 任务 #%d 执行成功\n", taskID)
+	updateTask(taskID, func(task *Task) {
+		task.Status = TaskStatusComplete
+		task.Output = output
+		task.HostResults = results
+		task.Artifacts = artifacts
+		task.Progress = 100
+		task.EndTime = &endTime
+	})
+	addNotification(NotificationTypeSuccess, fmt.Sprintf("任务 #%d 执行成功", taskID))
+	return nil
+}
+
+// waitForRunSlot 为任务占用执行名额, 需要排队时记录等待原因并通知 sink
+func waitForRunSlot(taskID int, locks []string, sink runSink) (func(), error) {
+	task, _ := findTask(taskID)
+	return acquireRunSlot(taskID, task.Username, locks, func(reason string) {
+		fmt.Printf("[Go] 任务 #%d 排队等待: %s\n", taskID, reason)
+		addTaskLog(taskID, "排队等待: "+reason, "info")
+		if sink != nil {
+			sink(fmt.Sprintf("Task #%d is queued: %s", taskID, reason), false)
+		}
+	})
+}
+
+// cancelTask 将因服务关闭而未执行完的任务标记为已取消
+func cancelTask(taskID int, err error) {
+	fmt.Printf("[Go] 任务 #%d 因服务关闭被取消\n", taskID)
+	endTime := time.Now()
+	updateTask(taskID, func(task *Task) {
+		task.Status = TaskStatusCanceled
+		task.Output = err.Error()
+		task.EndTime = &endTime
+	})
+	addNotification(NotificationTypeWarning, fmt.Sprintf("任务 #%d 因服务关闭被取消", taskID))
+}
+
+// failTask 将未能开始执行的任务标记为失败
+func failTask(taskID int, err error) {
+	endTime := time.Now()
+	updateTask(taskID, func(task *Task) {
+		task.Status = TaskStatusFailed
+		task.Output = err.Error()
+		task.EndTime = &endTime
+	})
+	addTaskLog(taskID, err.Error(), "error")
+	addNotification(NotificationTypeError, fmt.Sprintf("任务 #%d 执行失败", taskID))
+}
+
+// updateTask 在持有 tasksMutex 的情况下修改并保存任务, 任务不存在时返回 false
+func updateTask(taskID int, update func(task *Task)) bool {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+
+	for i := range tasks {
+		if tasks[i].ID == taskID {
+			update(&tasks[i])
+			saveTask(tasks[i])
+			return true
+		}
+	}
+	return false
+}
+
+// isRunRequestError 判断准备运行时的错误是否由请求引起
+func isRunRequestError(err error) bool {
+	var requestErr runRequestError
+	return errors.As(err, &requestErr)
+}
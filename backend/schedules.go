@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	_ "time/tzdata" // 系统没有时区数据时也能使用 timezone
+)
+
+const (
+	SCHEDULE_DATA_DIR = "/schedules" // 定时计划数据子目录
+
+	ScheduleResultStarted = "started"
+	ScheduleResultSkipped = "skipped"
+	ScheduleResultError   = "error"
+)
+
+// Schedule 定时执行一个 playbook 模板; 运行时使用最后一次保存计划的用户的权限
+type Schedule struct {
+	ID                int                    `json:"id"`
+	Name              string                 `json:"name"`
+	PlaybookTemplate  string                 `json:"playbook_template"`
+	InventoryTemplate string                 `json:"inventory_template"`
+	Variables         map[string]interface{} `json:"variables,omitempty"`
+	Secrets           []string               `json:"secrets,omitempty"`
+	CredentialID      int                    `json:"credential_id,omitempty"`
+	Cron              string                 `json:"cron"`     // 5 段 cron 表达式, 例如 "0 2 * * *", 也支持 @daily 等
+	Timezone          string                 `json:"timezone"` // IANA 时区, 例如 Asia/Shanghai, 默认 UTC
+	Enabled           bool                   `json:"enabled"`
+	SkipIfRunning     bool                   `json:"skip_if_running"` // 上一次运行未结束时跳过本次
+	OwnerID           int                    `json:"owner_id"`
+	Owner             string                 `json:"owner"`
+	NextRunAt         *time.Time             `json:"next_run_at,omitempty"`
+	LastRunAt         *time.Time             `json:"last_run_at,omitempty"`
+	LastTaskID        int                    `json:"last_task_id,omitempty"`
+	LastResult        string                 `json:"last_result,omitempty"` // started, skipped 或 error
+	LastMessage       string                 `json:"last_message,omitempty"`
+	CreatedAt         time.Time              `json:"created_at"`
+	UpdatedAt         time.Time              `json:"updated_at"`
+}
+
+var (
+	schedules      []Schedule
+	scheduleID     int
+	schedulesMutex sync.Mutex
+)
+
+func scheduleDataPath(id int) string {
+	return filepath.Join(DATA_DIR, SCHEDULE_DATA_DIR, fmt.Sprintf("%d.json", id))
+}
+
+func saveSchedule(schedule Schedule) error {
+	return writeJSONFile(scheduleDataPath(schedule.ID), schedule)
+}
+
+// request 返回计划对应的运行请求, 模板内容在运行时读取
+func (s Schedule) request() AnsibleRequest {
+	return AnsibleRequest{
+		PlaybookTemplate:  s.PlaybookTemplate,
+		InventoryTemplate: s.InventoryTemplate,
+		Variables:         s.Variables,
+		Secrets:           s.Secrets,
+		CredentialID:      s.CredentialID,
+	}
+}
+
+// scope 返回计划的权限范围; 模板已被删除时只按模板名称判断
+func (s Schedule) scope() PermissionScope {
+	req := s.request()
+	resolveRunTemplates(&req)
+	return runScope(req)
+}
+
+// nextRun 计算 after 之后的下一次运行时间, 计划停用时为 nil
+func (s Schedule) nextRun(after time.Time) *time.Time {
+	if !s.Enabled {
+		return nil
+	}
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil
+	}
+	next, ok := spec.next(after, loc)
+	if !ok {
+		return nil
+	}
+	return &next
+}
+
+// loadSchedulesFromFiles 加载定时计划; 停机期间错过的运行不补执行, 从当前时间重新计算下一次运行
+func loadSchedulesFromFiles() error {
+	schedules = []Schedule{}
+
+	dir := filepath.Join(DATA_DIR, SCHEDULE_DATA_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var schedule Schedule
+		if err := json.Unmarshal(data, &schedule); err != nil {
+			fmt.Printf("[Go] 跳过无效的计划文件 %s: %v\n", entry.Name(), err)
+			continue
+		}
+		schedule.NextRunAt = schedule.nextRun(now)
+		if schedule.ID > scheduleID {
+			scheduleID = schedule.ID
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+	return nil
+}
+
+// runScheduler 每分钟检查一次到期的计划, 服务关闭时停止
+func runScheduler() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		if runsDraining() {
+			return
+		}
+		runDueSchedules(time.Now())
+	}
+}
+
+// runDueSchedules 启动所有到期的计划, 先更新下一次运行时间再执行, 避免重复触发
+func runDueSchedules(now time.Time) {
+	var due []Schedule
+	schedulesMutex.Lock()
+	for i := range schedules {
+		s := &schedules[i]
+		if !s.Enabled || s.NextRunAt == nil || s.NextRunAt.After(now) {
+			continue
+		}
+		s.NextRunAt = s.nextRun(now)
+		due = append(due, *s)
+	}
+	schedulesMutex.Unlock()
+
+	for _, schedule := range due {
+		taskID, result, message := runSchedule(schedule)
+		if result != ScheduleResultStarted {
+			fmt.Printf("[Go] 计划 %s 未执行 (%s): %s\n", schedule.Name, result, message)
+			addNotification(NotificationTypeWarning, fmt.Sprintf("计划 %s 未执行: %s", schedule.Name, message))
+		}
+
+		schedulesMutex.Lock()
+		for i := range schedules {
+			if schedules[i].ID != schedule.ID {
+				continue
+			}
+			runAt := now
+			schedules[i].LastRunAt = &runAt
+			schedules[i].LastResult = result
+			schedules[i].LastMessage = message
+			if taskID != 0 {
+				schedules[i].LastTaskID = taskID
+			}
+			if err := saveSchedule(schedules[i]); err != nil {
+				fmt.Printf("[Go] 保存计划失败: %v\n", err)
+			}
+		}
+		schedulesMutex.Unlock()
+	}
+}
+
+// runSchedule 以计划所有者的身份, 通过与 /run 相同的流程创建并执行任务
+func runSchedule(schedule Schedule) (int, string, string) {
+	if schedule.SkipIfRunning && schedule.LastTaskID != 0 {
+		running := false
+		tasksMutex.Lock()
+		for _, task := range tasks {
+			if task.ID == schedule.LastTaskID && !taskFinished(task.Status) {
+				running = true
+			}
+		}
+		tasksMutex.Unlock()
+		if running {
+			return 0, ScheduleResultSkipped, fmt.Sprintf("previous run task #%d has not finished", schedule.LastTaskID)
+		}
+	}
+
+	// 所有者被禁用、删除或不再有权限时不执行
+	owner, ok := findUserByID(schedule.OwnerID)
+	if !ok || owner.Disabled {
+		return 0, ScheduleResultSkipped, "schedule owner is no longer active"
+	}
+	req := schedule.request()
+	if err := resolveRunTemplates(&req); err != nil {
+		return 0, ScheduleResultError, err.Error()
+	}
+	if !userCanRun(owner, req) {
+		return 0, ScheduleResultSkipped, fmt.Sprintf("%s is no longer allowed to run this playbook", owner.Username)
+	}
+
+	if !beginRun() {
+		return 0, ScheduleResultSkipped, "server is shutting down"
+	}
+	run, err := prepareRun(req)
+	if err != nil {
+		endRun()
+		return 0, ScheduleResultError, err.Error()
+	}
+
+	task := newRunTask(req, run, owner, APIToken{})
+	task.ScheduleID = schedule.ID
+	task = createTask(task)
+	fmt.Printf("[Go] 计划 %s 创建新任务 #%d\n", schedule.Name, task.ID)
+	writeAudit(nil, AuditEntry{
+		Actor:   owner.Username,
+		UserID:  owner.ID,
+		Action:  "run",
+		Target:  fmt.Sprintf("task/%d", task.ID),
+		Outcome: AuditOutcomeSuccess,
+		After:   auditDigest(task),
+		Detail:  fmt.Sprintf("schedule/%d", schedule.ID),
+	})
+
+	go func() {
+		defer endRun()
+		defer run.cleanup()
+		dispatchRun(task.ID, req, run, nil)
+	}()
+	return task.ID, ScheduleResultStarted, fmt.Sprintf("task #%d", task.ID)
+}
+
+// validateSchedule 检查计划的字段并补全默认值, 返回用于权限检查的运行请求
+func validateSchedule(schedule *Schedule) (AnsibleRequest, error) {
+	if !namePattern.MatchString(schedule.Name) {
+		return AnsibleRequest{}, fmt.Errorf("invalid schedule name")
+	}
+	if schedule.PlaybookTemplate == "" || schedule.InventoryTemplate == "" {
+		return AnsibleRequest{}, fmt.Errorf("playbook_template and inventory_template are required")
+	}
+	if _, err := parseCron(schedule.Cron); err != nil {
+		return AnsibleRequest{}, fmt.Errorf("invalid cron expression: %v", err)
+	}
+	if schedule.Timezone == "" {
+		schedule.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+		return AnsibleRequest{}, fmt.Errorf("invalid timezone %q", schedule.Timezone)
+	}
+	req := schedule.request()
+	if err := resolveRunTemplates(&req); err != nil {
+		return AnsibleRequest{}, err
+	}
+	return req, nil
+}
+
+func getSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	schedulesMutex.Lock()
+	defer schedulesMutex.Unlock()
+	json.NewEncoder(w).Encode(schedules)
+}
+
+func addScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var schedule Schedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	user, _ := currentUser(r)
+	if user.ID == 0 {
+		http.Error(w, "Schedules require a user account", http.StatusForbidden)
+		return
+	}
+	req, err := validateSchedule(&schedule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeRun(w, r, req) {
+		return
+	}
+
+	schedulesMutex.Lock()
+	defer schedulesMutex.Unlock()
+
+	for _, s := range schedules {
+		if s.Name == schedule.Name {
+			http.Error(w, "Schedule already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	now := time.Now()
+	scheduleID++
+	schedule.ID = scheduleID
+	schedule.OwnerID = user.ID
+	schedule.Owner = user.Username
+	schedule.NextRunAt = schedule.nextRun(now)
+	schedule.LastRunAt = nil
+	schedule.LastTaskID = 0
+	schedule.LastResult = ""
+	schedule.LastMessage = ""
+	schedule.CreatedAt = now
+	schedule.UpdatedAt = now
+	if err := saveSchedule(schedule); err != nil {
+		scheduleID--
+		fmt.Printf("[Go] 保存计划失败: %v\n", err)
+		http.Error(w, "Failed to save schedule", http.StatusInternalServerError)
+		return
+	}
+	schedules = append(schedules, schedule)
+	recordAudit(r, "schedule.add", "schedule/"+schedule.Name, nil, schedule)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// updateScheduleHandler 修改计划, 修改前后的目标都需要在权限范围内; 修改人成为新的所有者
+func updateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var updated Schedule
+	if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	user, _ := currentUser(r)
+	if user.ID == 0 {
+		http.Error(w, "Schedules require a user account", http.StatusForbidden)
+		return
+	}
+	req, err := validateSchedule(&updated)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeRun(w, r, req) {
+		return
+	}
+
+	schedulesMutex.Lock()
+	defer schedulesMutex.Unlock()
+
+	index := -1
+	for i, s := range schedules {
+		if s.ID == updated.ID {
+			index = i
+		} else if s.Name == updated.Name {
+			http.Error(w, "Schedule already exists", http.StatusConflict)
+			return
+		}
+	}
+	if index < 0 {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	existing := schedules[index]
+	if !canAccess(r, ActionRun, existing.scope()) {
+		forbidden(w, r, ActionRun)
+		return
+	}
+
+	updated.OwnerID = user.ID
+	updated.Owner = user.Username
+	updated.NextRunAt = updated.nextRun(time.Now())
+	updated.LastRunAt = existing.LastRunAt
+	updated.LastTaskID = existing.LastTaskID
+	updated.LastResult = existing.LastResult
+	updated.LastMessage = existing.LastMessage
+	updated.CreatedAt = existing.CreatedAt
+	updated.UpdatedAt = time.Now()
+	if err := saveSchedule(updated); err != nil {
+		fmt.Printf("[Go] 保存计划失败: %v\n", err)
+		http.Error(w, "Failed to save schedule", http.StatusInternalServerError)
+		return
+	}
+	schedules[index] = updated
+	recordAudit(r, "schedule.update", "schedule/"+updated.Name, existing, updated)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func deleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+
+	schedulesMutex.Lock()
+	defer schedulesMutex.Unlock()
+
+	for i := range schedules {
+		if schedules[i].ID != id {
+			continue
+		}
+		schedule := schedules[i]
+		if !canAccess(r, ActionRun, schedule.scope()) {
+			forbidden(w, r, ActionRun)
+			return
+		}
+		if err := os.Remove(scheduleDataPath(schedule.ID)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Go] 删除计划文件失败: %v\n", err)
+			http.Error(w, "Failed to delete schedule file", http.StatusInternalServerError)
+			return
+		}
+		schedules = append(schedules[:i], schedules[i+1:]...)
+		recordAudit(r, "schedule.delete", "schedule/"+schedule.Name, schedule, nil)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(schedule)
+		return
+	}
+
+	http.Error(w, "Schedule not found", http.StatusNotFound)
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SECRET_DATA_DIR = "/secrets"    // 加密后的机密数据子目录
+	MASTER_KEY_FILE = "/master.key" // 服务端主密钥文件, 未设置环境变量时使用
+
+	masterKeyEnv = "ANSIBLE_WEB_MASTER_KEY" // 主密钥环境变量, 优先于密钥文件
+
+	runVaultPasswordFile = "vault-pass" // 运行目录中的 vault 密码文件
+)
+
+// Secret 是对外可见的机密信息, 不包含机密值
+type Secret struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// storedSecret 是持久化到磁盘的机密, 值使用主密钥以 AES-256-GCM 加密
+type storedSecret struct {
+	Secret
+	Ciphertext string `json:"ciphertext"`
+}
+
+// SecretRequest 是新增和更新机密的请求体, Value 只写不读
+type SecretRequest struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Value       string `json:"value"`
+}
+
+var (
+	secrets      []storedSecret
+	secretID     int
+	secretsMutex sync.Mutex
+	masterKey    []byte
+)
+
+// 机密名称会作为 ansible 变量名使用
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// inventory 中以 {{ name }} 引用的变量
+var secretRefPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// loadMasterKey 从环境变量或密钥文件加载主密钥, 密钥文件不存在时自动生成
+func loadMasterKey() error {
+	if value := os.Getenv(masterKeyEnv); value != "" {
+		sum := sha256.Sum256([]byte(value))
+		masterKey = sum[:]
+		return nil
+	}
+
+	path := filepath.Join(DATA_DIR, MASTER_KEY_FILE)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("invalid master key file %s", path)
+		}
+		masterKey = key
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return err
+	}
+	fmt.Printf("[Go] 已生成新的主密钥: %s\n", path)
+	masterKey = key
+	return nil
+}
+
+// encryptSecretValue 使用主密钥加密机密值, 机密名称作为附加数据防止密文被挪用
+func encryptSecretValue(name, value string) (string, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecretValue(name, ciphertext string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret %s: %v", name, err)
+	}
+	return string(plain), nil
+}
+
+func secretDataPath(name string) string {
+	return filepath.Join(DATA_DIR, SECRET_DATA_DIR, name+".json")
+}
+
+func saveSecretFile(secret storedSecret) error {
+	data, err := json.MarshalIndent(secret, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := secretDataPath(secret.Name)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 从文件系统加载机密
+func loadSecretsFromFiles() error {
+	secrets = []storedSecret{}
+
+	dir := filepath.Join(DATA_DIR, SECRET_DATA_DIR)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var secret storedSecret
+		if err := json.Unmarshal(data, &secret); err != nil {
+			fmt.Printf("[Go] 跳过无效的机密文件 %s: %v\n", entry.Name(), err)
+			continue
+		}
+		// 启动时校验主密钥能否解密, 避免运行时才发现密钥不匹配
+		if _, err := decryptSecretValue(secret.Name, secret.Ciphertext); err != nil {
+			return err
+		}
+		if secret.ID > secretID {
+			secretID = secret.ID
+		}
+		secrets = append(secrets, secret)
+	}
+
+	return nil
+}
+
+// resolveSecrets 解密指定名称的机密, 返回 变量名 -> 值
+func resolveSecrets(names []string) (map[string]string, error) {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	values := map[string]string{}
+	for _, name := range names {
+		if _, ok := values[name]; ok {
+			continue
+		}
+		found := false
+		for _, secret := range secrets {
+			if secret.Name == name {
+				value, err := decryptSecretValue(secret.Name, secret.Ciphertext)
+				if err != nil {
+					return nil, err
+				}
+				values[name] = value
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("secret %q not found", name)
+		}
+	}
+	return values, nil
+}
+
+// referencedSecrets 找出 inventory 中以 {{ name }} 引用的已存在机密
+func referencedSecrets(content string) []string {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	var names []string
+	seen := map[string]bool{}
+	for _, match := range secretRefPattern.FindAllStringSubmatch(content, -1) {
+		name := match[1]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		for _, secret := range secrets {
+			if secret.Name == name {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// runVaultPassword 返回本次运行的 vault 密码, 首次调用时随机生成并写入运行目录
+func runVaultPassword(tmpDir string) (string, error) {
+	passwordFile := filepath.Join(tmpDir, runVaultPasswordFile)
+	if data, err := ioutil.ReadFile(passwordFile); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	password := hex.EncodeToString(raw)
+	if err := ioutil.WriteFile(passwordFile, []byte(password+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// runVaultArgs 在运行目录中使用过 vault 时返回 --vault-password-file 参数
+func runVaultArgs(tmpDir string) []string {
+	passwordFile := filepath.Join(tmpDir, runVaultPasswordFile)
+	if _, err := os.Stat(passwordFile); err != nil {
+		return nil
+	}
+	return []string{"--vault-password-file", passwordFile}
+}
+
+// writeVaultFile 将变量以 vault 加密的 YAML 文件写入运行目录
+func writeVaultFile(tmpDir, path string, vars interface{}) error {
+	password, err := runVaultPassword(tmpDir)
+	if err != nil {
+		return err
+	}
+	// JSON 是合法的 YAML, 可直接作为变量文件
+	plain, err := json.Marshal(vars)
+	if err != nil {
+		return err
+	}
+	encrypted, err := vaultEncrypt(plain, password)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(encrypted), 0600)
+}
+
+// prepareRunSecrets 将机密写入运行目录中 vault 加密的变量文件,
+// 返回需要追加到 ansible-playbook 的参数
+func prepareRunSecrets(tmpDir string, names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	values, err := resolveSecrets(names)
+	if err != nil {
+		return nil, err
+	}
+
+	varsFile := filepath.Join(tmpDir, "secrets.yml")
+	if err := writeVaultFile(tmpDir, varsFile, values); err != nil {
+		return nil, err
+	}
+	return []string{"-e", "@" + varsFile}, nil
+}
+
+func getSecretsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	list := make([]Secret, 0, len(secrets))
+	for _, secret := range secrets {
+		list = append(list, secret.Secret)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func addSecretHandler(w http.ResponseWriter, r *http.Request) {
+	var req SecretRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !secretNamePattern.MatchString(req.Name) {
+		http.Error(w, "Invalid secret name, must be a valid variable name", http.StatusBadRequest)
+		return
+	}
+	if req.Value == "" {
+		http.Error(w, "Missing secret value", http.StatusBadRequest)
+		return
+	}
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	for _, existing := range secrets {
+		if existing.Name == req.Name {
+			http.Error(w, "Secret name already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	ciphertext, err := encryptSecretValue(req.Name, req.Value)
+	if err != nil {
+		fmt.Printf("[Go] 加密机密失败: %v\n", err)
+		http.Error(w, "Failed to encrypt secret", http.StatusInternalServerError)
+		return
+	}
+
+	secret := storedSecret{
+		Secret: Secret{
+			ID:          secretID + 1,
+			Name:        req.Name,
+			Description: req.Description,
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+		},
+		Ciphertext: ciphertext,
+	}
+	if err := saveSecretFile(secret); err != nil {
+		fmt.Printf("[Go] 保存机密文件失败: %v\n", err)
+		http.Error(w, "Failed to save secret", http.StatusInternalServerError)
+		return
+	}
+	secretID++
+	secrets = append(secrets, secret)
+	recordAudit(r, "secret.add", "secret/"+secret.Name, nil, secret)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secret.Secret)
+}
+
+// updateSecretHandler 更新描述, 提供 value 时同时替换机密值; 不支持重命名
+func updateSecretHandler(w http.ResponseWriter, r *http.Request) {
+	var req SecretRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	for i := range secrets {
+		if secrets[i].ID != req.ID {
+			continue
+		}
+		secret := secrets[i]
+		secret.Description = req.Description
+		if req.Value != "" {
+			ciphertext, err := encryptSecretValue(secret.Name, req.Value)
+			if err != nil {
+				fmt.Printf("[Go] 加密机密失败: %v\n", err)
+				http.Error(w, "Failed to encrypt secret", http.StatusInternalServerError)
+				return
+			}
+			secret.Ciphertext = ciphertext
+		}
+		secret.UpdatedAt = time.Now()
+		if err := saveSecretFile(secret); err != nil {
+			fmt.Printf("[Go] 保存机密文件失败: %v\n", err)
+			http.Error(w, "Failed to save secret", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "secret.update", "secret/"+secret.Name, secrets[i], secret)
+		secrets[i] = secret
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(secret.Secret)
+		return
+	}
+
+	http.Error(w, "Secret not found", http.StatusNotFound)
+}
+
+func deleteSecretHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	for i := range secrets {
+		if secrets[i].ID != id {
+			continue
+		}
+		secret := secrets[i]
+		if err := os.Remove(secretDataPath(secret.Name)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Go] 删除机密文件失败: %v\n", err)
+			http.Error(w, "Failed to delete secret", http.StatusInternalServerError)
+			return
+		}
+		secrets = append(secrets[:i], secrets[i+1:]...)
+		recordAudit(r, "secret.delete", "secret/"+secret.Name, secret, nil)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(secret.Secret)
+		return
+	}
+
+	http.Error(w, "Secret not found", http.StatusNotFound)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 运行超过关闭期限后被取消的任务
+const TaskStatusCanceled TaskStatus = "canceled"
+
+// cancelRunsGrace 是取消运行后等待进程退出的时间
+const cancelRunsGrace = 10 * time.Second
+
+var (
+	// runsContext 在关闭期限到达时取消, 所有 ansible-playbook 进程都由它派生
+	runsContext, cancelRuns = context.WithCancel(context.Background())
+
+	activeRuns    sync.WaitGroup
+	draining      bool
+	drainingMutex sync.Mutex
+)
+
+// beginRun 登记一次运行, 服务正在关闭时返回 false; 登记成功后需要调用 endRun
+func beginRun() bool {
+	drainingMutex.Lock()
+	defer drainingMutex.Unlock()
+
+	if draining {
+		return false
+	}
+	activeRuns.Add(1)
+	return true
+}
+
+func endRun() {
+	activeRuns.Done()
+}
+
+// runsDraining 判断服务是否正在关闭, 用于在处理请求前提前拒绝
+func runsDraining() bool {
+	drainingMutex.Lock()
+	defer drainingMutex.Unlock()
+	return draining
+}
+
+// startBackgroundRun 在后台执行运行, 服务正在关闭时不执行并返回 false
+func startBackgroundRun(run func()) bool {
+	if !beginRun() {
+		return false
+	}
+	go func() {
+		defer endRun()
+		run()
+	}()
+	return true
+}
+
+// waitForRuns 等待所有运行结束, 超时返回 false
+func waitForRuns(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		activeRuns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// handleShutdownSignals 收到 SIGINT 或 SIGTERM 后停止接受新的运行并关闭监听,
+// 等待进行中的运行结束, 超过 shutdown_timeout 后取消剩余运行, 最后保存任务状态
+func handleShutdownSignals(server *http.Server, done chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+	fmt.Printf("[Go] 收到 %v, 开始关闭服务\n", sig)
+
+	drainingMutex.Lock()
+	draining = true
+	drainingMutex.Unlock()
+
+	// 关闭监听后, 正在通过 SSE 输出的运行请求仍会继续, 直到运行结束或被取消
+	timeout := time.Duration(serverConfig.ShutdownTimeout)
+	shutdownDone := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout+cancelRunsGrace)
+		defer cancel()
+		server.Shutdown(ctx)
+		close(shutdownDone)
+	}()
+
+	if !waitForRuns(timeout) {
+		fmt.Printf("[Go] 等待运行结束超时 (%v), 取消剩余的运行\n", timeout)
+		cancelRuns()
+		if !waitForRuns(cancelRunsGrace) {
+			fmt.Printf("[Go] 部分运行未能在 %v 内退出\n", cancelRunsGrace)
+		}
+	}
+	<-shutdownDone
+
+	if err := saveAllTasks(); err != nil {
+		fmt.Printf("[Go] 保存任务状态失败: %v\n", err)
+	}
+	fmt.Printf("[Go] 服务已关闭\n")
+	close(done)
+}
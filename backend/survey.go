@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 调查表字段类型
+const (
+	SurveyTypeString      = "string"
+	SurveyTypeInt         = "int"
+	SurveyTypeBool        = "bool"
+	SurveyTypeChoice      = "choice"
+	SurveyTypeMultiChoice = "multi_choice"
+	SurveyTypePassword    = "password"
+	SurveyTypeTextarea    = "textarea"
+)
+
+// SurveyField 是 playbook 模板调查表中的一个变量
+type SurveyField struct {
+	Name     string      `json:"name"`
+	Label    string      `json:"label,omitempty"`
+	Type     string      `json:"type"`
+	Default  interface{} `json:"default,omitempty"`
+	Min      *int        `json:"min,omitempty"`     // int 为最小值, 字符串类型为最小长度, multi_choice 为最少选择数
+	Max      *int        `json:"max,omitempty"`     // 与 min 对应的上限
+	Regex    string      `json:"regex,omitempty"`   // 字符串类型的值需要完整匹配
+	Choices  []string    `json:"choices,omitempty"` // choice 和 multi_choice 的选项
+	Required bool        `json:"required,omitempty"`
+}
+
+var surveyNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateSurvey 检查调查表定义, 包括默认值是否满足字段自身的约束
+func validateSurvey(fields []SurveyField) error {
+	seen := map[string]bool{}
+	for _, field := range fields {
+		if !surveyNamePattern.MatchString(field.Name) {
+			return fmt.Errorf("invalid survey variable name %q", field.Name)
+		}
+		if seen[field.Name] {
+			return fmt.Errorf("duplicate survey variable %q", field.Name)
+		}
+		seen[field.Name] = true
+
+		switch field.Type {
+		case SurveyTypeString, SurveyTypeInt, SurveyTypeBool, SurveyTypePassword, SurveyTypeTextarea:
+		case SurveyTypeChoice, SurveyTypeMultiChoice:
+			if len(field.Choices) == 0 {
+				return fmt.Errorf("survey variable %s: choices are required", field.Name)
+			}
+		default:
+			return fmt.Errorf("survey variable %s: invalid type %q", field.Name, field.Type)
+		}
+		if field.Min != nil && field.Max != nil && *field.Min > *field.Max {
+			return fmt.Errorf("survey variable %s: min is greater than max", field.Name)
+		}
+		if field.Regex != "" {
+			if _, err := regexp.Compile(field.Regex); err != nil {
+				return fmt.Errorf("survey variable %s: invalid regex: %v", field.Name, err)
+			}
+		}
+		if field.Default != nil {
+			if _, err := field.value(field.Default); err != nil {
+				return fmt.Errorf("survey variable %s: invalid default: %v", field.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// value 检查并转换提交的值; 表单提交的数字和布尔值可以是字符串
+func (f SurveyField) value(v interface{}) (interface{}, error) {
+	switch f.Type {
+	case SurveyTypeInt:
+		var n float64
+		switch v := v.(type) {
+		case float64:
+			n = v
+		case string:
+			i, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("must be an integer")
+			}
+			n = float64(i)
+		default:
+			return nil, fmt.Errorf("must be an integer")
+		}
+		if n != math.Trunc(n) {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		if err := f.checkRange(n, "value"); err != nil {
+			return nil, err
+		}
+		return int(n), nil
+
+	case SurveyTypeBool:
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("must be a boolean")
+
+	case SurveyTypeChoice:
+		s, ok := v.(string)
+		if !ok || !f.hasChoice(s) {
+			return nil, fmt.Errorf("must be one of %s", strings.Join(f.Choices, ", "))
+		}
+		return s, nil
+
+	case SurveyTypeMultiChoice:
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("must be a list")
+		}
+		values := []string{}
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok || !f.hasChoice(s) {
+				return nil, fmt.Errorf("%v is not one of %s", item, strings.Join(f.Choices, ", "))
+			}
+			values = append(values, s)
+		}
+		if err := f.checkRange(float64(len(values)), "number of choices"); err != nil {
+			return nil, err
+		}
+		return values, nil
+
+	default: // string、password、textarea
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string")
+		}
+		if err := f.checkRange(float64(len([]rune(s))), "length"); err != nil {
+			return nil, err
+		}
+		if f.Regex != "" && !regexp.MustCompile(`^(?:`+f.Regex+`)$`).MatchString(s) {
+			return nil, fmt.Errorf("does not match %s", f.Regex)
+		}
+		return s, nil
+	}
+}
+
+func (f SurveyField) checkRange(n float64, what string) error {
+	if f.Min != nil && n < float64(*f.Min) {
+		return fmt.Errorf("%s must be at least %d", what, *f.Min)
+	}
+	if f.Max != nil && n > float64(*f.Max) {
+		return fmt.Errorf("%s must be at most %d", what, *f.Max)
+	}
+	return nil
+}
+
+func (f SurveyField) hasChoice(s string) bool {
+	for _, choice := range f.Choices {
+		if choice == s {
+			return true
+		}
+	}
+	return false
+}
+
+// surveyEmpty 判断提交的值是否视为未填写
+func surveyEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// surveyVars 返回调查表限制的变量名; 没有调查表或模板允许额外变量时返回 nil, 表示不限制
+func (t PlaybookTemplate) surveyVars() map[string]bool {
+	if len(t.Survey) == 0 || t.AllowExtraVars {
+		return nil
+	}
+	declared := make(map[string]bool, len(t.Survey))
+	for _, field := range t.Survey {
+		declared[field.Name] = true
+	}
+	return declared
+}
+
+// applySurvey 按 playbook 模板的调查表检查运行变量, 未填写的变量使用默认值; 调查表以外的变量
+// 可能覆盖 ansible_become_user 等连接变量, 只有模板设置了 allow_extra_vars 时才原样传递, 否则拒绝。
+// 返回 password 类型变量的值, 用于输出脱敏
+func applySurvey(req *AnsibleRequest) ([]string, error) {
+	if req.PlaybookTemplate == "" || req.Adhoc != nil {
+		return nil, nil
+	}
+	template, ok := findTemplate("playbook", req.PlaybookTemplate)
+	if !ok || len(template.Survey) == 0 {
+		return nil, nil
+	}
+
+	if declared := template.surveyVars(); declared != nil {
+		var undeclared []string
+		for name := range req.Variables {
+			if !declared[name] {
+				undeclared = append(undeclared, name)
+			}
+		}
+		if len(undeclared) > 0 {
+			sort.Strings(undeclared)
+			return nil, fmt.Errorf("variables not in the survey of %s: %s", template.Name, strings.Join(undeclared, ", "))
+		}
+	}
+
+	variables := make(map[string]interface{}, len(req.Variables)+len(template.Survey))
+	for name, value := range req.Variables {
+		variables[name] = value
+	}
+	var passwords []string
+	for _, field := range template.Survey {
+		value, ok := variables[field.Name]
+		if !ok || surveyEmpty(value) {
+			if field.Default == nil {
+				if field.Required {
+					return nil, fmt.Errorf("variable %s is required", field.Name)
+				}
+				delete(variables, field.Name)
+				continue
+			}
+			value = field.Default
+		}
+		converted, err := field.value(value)
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %v", field.Name, err)
+		}
+		variables[field.Name] = converted
+		if s, ok := converted.(string); ok && field.Type == SurveyTypePassword && s != "" {
+			passwords = append(passwords, s)
+		}
+	}
+	req.Variables = variables
+	return passwords, nil
+}
+
+var (
+	// surveyVarPattern 匹配 {{ name }}、{{ name.attr }}、{{ name | default('x') }} 中的第一个变量名
+	surveyVarPattern      = regexp.MustCompile(`\{\{-?\s*([A-Za-z_][A-Za-z0-9_]*)([^}]*)\}\}`)
+	surveyDefaultPattern  = regexp.MustCompile(`\|\s*(?:default|d)\(\s*(?:'([^']*)'|"([^"]*)"|(-?[0-9]+)|(true|false|True|False))?`)
+	surveyRegisterPattern = regexp.MustCompile(`^\s*-?\s*register:\s*([A-Za-z_][A-Za-z0-9_]*)\s*$`)
+)
+
+// surveyBuiltinVars 是 ansible 内置或由 playbook 运行时提供的变量, 不作为调查表建议
+var surveyBuiltinVars = map[string]bool{
+	"item": true, "omit": true, "hostvars": true, "groups": true, "group_names": true,
+	"inventory_hostname": true, "inventory_hostname_short": true, "inventory_dir": true, "inventory_file": true,
+	"play_hosts": true, "ansible_play_hosts": true, "ansible_play_batch": true, "playbook_dir": true,
+	"role_path": true, "role_name": true, "environment": true, "vars": true, "lookup": true, "query": true,
+	"q": true, "range": true, "true": true, "false": true, "none": true, "True": true, "False": true, "None": true,
+}
+
+// suggestSurvey 扫描 playbook 中的 vars_prompt 和 {{ var }} 引用, 生成建议的调查表;
+// vars_prompt 中的变量按 private 设置为 password 或 string, 带 default 过滤器的引用不是必填项
+func suggestSurvey(content string) []SurveyField {
+	var fields []SurveyField
+	index := map[string]int{}
+	add := func(field SurveyField) {
+		if _, ok := index[field.Name]; ok {
+			return
+		}
+		index[field.Name] = len(fields)
+		fields = append(fields, field)
+	}
+
+	for _, prompt := range parseVarsPrompt(content) {
+		add(prompt)
+	}
+
+	registered := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		if m := surveyRegisterPattern.FindStringSubmatch(stripYAMLComment(scanner.Text())); m != nil {
+			registered[m[1]] = true
+		}
+	}
+
+	var referenced []SurveyField
+	for _, m := range surveyVarPattern.FindAllStringSubmatch(content, -1) {
+		name := m[1]
+		if surveyBuiltinVars[name] || registered[name] || strings.HasPrefix(name, "ansible_") {
+			continue
+		}
+		if _, ok := index[name]; ok {
+			continue
+		}
+		field := SurveyField{Name: name, Type: SurveyTypeString, Required: true}
+		if d := surveyDefaultPattern.FindStringSubmatch(m[2]); d != nil {
+			field.Required = false
+			switch {
+			case d[1] != "" || d[2] != "":
+				field.Default = d[1] + d[2]
+			case d[3] != "":
+				field.Type = SurveyTypeInt
+				n, _ := strconv.Atoi(d[3])
+				field.Default = n
+			case d[4] != "":
+				field.Type = SurveyTypeBool
+				field.Default = strings.EqualFold(d[4], "true")
+			}
+		}
+		index[name] = -1
+		referenced = append(referenced, field)
+	}
+	sort.Slice(referenced, func(i, j int) bool { return referenced[i].Name < referenced[j].Name })
+	return append(fields, referenced...)
+}
+
+// parseVarsPrompt 解析 playbook 中 vars_prompt 列表的 name、prompt、private 和 default
+func parseVarsPrompt(content string) []SurveyField {
+	var fields []SurveyField
+	var current *SurveyField
+	flush := func() {
+		if current != nil && surveyNamePattern.MatchString(current.Name) {
+			current.Required = current.Default == nil
+			fields = append(fields, *current)
+		}
+		current = nil
+	}
+
+	promptIndent, itemIndent := -1, -1
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		raw := stripYAMLComment(scanner.Text())
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" {
+			continue
+		}
+		indent := len(raw) - len(strings.TrimLeft(raw, " "))
+
+		// vars_prompt: 可能是 play 列表项的第一个键 (- vars_prompt:)
+		key := strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+		if key == "vars_prompt:" {
+			flush()
+			promptIndent = indent
+			if strings.HasPrefix(trimmed, "-") {
+				promptIndent = indent + len(trimmed) - len(strings.TrimLeft(strings.TrimPrefix(trimmed, "-"), " "))
+			}
+			itemIndent = -1
+			continue
+		}
+		if promptIndent < 0 {
+			continue
+		}
+		if indent <= promptIndent && !(indent == promptIndent && strings.HasPrefix(trimmed, "-")) {
+			flush()
+			promptIndent = -1
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "-") && (itemIndent == -1 || indent == itemIndent) {
+			flush()
+			itemIndent = indent
+			current = &SurveyField{Type: SurveyTypePassword} // private 默认为 yes
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+		}
+		if current == nil {
+			continue
+		}
+		idx := strings.Index(trimmed, ":")
+		if idx < 0 {
+			continue
+		}
+		value := unquoteYAML(strings.TrimSpace(trimmed[idx+1:]))
+		switch strings.TrimSpace(trimmed[:idx]) {
+		case "name":
+			current.Name = value
+		case "prompt":
+			current.Label = value
+		case "default":
+			current.Default = value
+		case "private":
+			switch strings.ToLower(value) {
+			case "no", "false", "off":
+				current.Type = SurveyTypeString
+			}
+		}
+	}
+	flush()
+	return fields
+}
+
+// surveyVariableNames 返回 playbook 中可能需要由运行请求提供的变量名
+func surveyVariableNames(content string) []string {
+	names := []string{}
+	for _, field := range suggestSurvey(content) {
+		names = append(names, field.Name)
+	}
+	return names
+}
+
+// suggestSurveyHandler 根据请求中的 playbook 内容或已保存的模板返回建议的调查表,
+// 已经定义的字段保持不变, 只追加新发现的变量
+func suggestSurveyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Template string `json:"template"`
+		Content  string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	var existing []SurveyField
+	if req.Template != "" {
+		template, ok := findTemplate("playbook", req.Template)
+		if !ok {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		}
+		if req.Content == "" {
+			req.Content = template.Content
+		}
+		existing = template.Survey
+	}
+
+	fields := append([]SurveyField{}, existing...)
+	defined := map[string]bool{}
+	for _, field := range existing {
+		defined[field.Name] = true
+	}
+	for _, field := range suggestSurvey(req.Content) {
+		if !defined[field.Name] {
+			fields = append(fields, field)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fields)
+}
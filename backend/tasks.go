@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const TASK_DATA_DIR = "/tasks" // 任务记录子目录, 每个任务一个文件
+
+func taskDataPath(id int) string {
+	return filepath.Join(DATA_DIR, TASK_DATA_DIR, fmt.Sprintf("%d.json", id))
+}
+
+// saveTask 保存任务记录, 调用方需要持有 tasksMutex
+func saveTask(task Task) {
+	if err := writeJSONFile(taskDataPath(task.ID), task); err != nil {
+		fmt.Printf("[Go] 保存任务 #%d 失败: %v\n", task.ID, err)
+	}
+}
+
+// createTask 分配任务 ID, 加入任务列表并保存
+func createTask(task Task) Task {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+
+	taskID++
+	task.ID = taskID
+	tasks = append(tasks, task)
+	saveTask(task)
+	return task
+}
+
+// findTask 返回任务的副本
+func findTask(taskID int) (Task, bool) {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+
+	for _, task := range tasks {
+		if task.ID == taskID {
+			return task, true
+		}
+	}
+	return Task{}, false
+}
+
+// saveAllTasks 在关闭服务前保存所有任务的最终状态
+func saveAllTasks() error {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+
+	for _, task := range tasks {
+		if err := writeJSONFile(taskDataPath(task.ID), task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// taskFinished 判断任务是否已经结束
+func taskFinished(status TaskStatus) bool {
+	switch status {
+	case TaskStatusComplete, TaskStatusFailed, TaskStatusRejected, TaskStatusCanceled, TaskStatusTimedOut:
+		return true
+	}
+	return false
+}
+
+// loadTasksFromFiles 加载任务记录; 上次退出时未结束的任务无法继续, 标记为已取消;
+// 等待审批的任务保持原状态, 由 restorePendingRuns 恢复
+func loadTasksFromFiles() error {
+	tasks = []Task{}
+
+	dir := filepath.Join(DATA_DIR, TASK_DATA_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var task Task
+		if err := json.Unmarshal(data, &task); err != nil {
+			fmt.Printf("[Go] 跳过无效的任务文件 %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if !taskFinished(task.Status) && task.Status != TaskStatusAwaitingApproval {
+			fmt.Printf("[Go] 任务 #%d 在服务重启前未结束 (%s), 标记为已取消\n", task.ID, task.Status)
+			task.Status = TaskStatusCanceled
+			task.Output += "\nInterrupted by server restart"
+			task.EndTime = &now
+			if task.Workflow != nil {
+				for i := range task.Workflow.Nodes {
+					if n := &task.Workflow.Nodes[i]; n.Status == WorkflowNodePending || n.Status == WorkflowNodeRunning {
+						n.Status = string(TaskStatusCanceled)
+					}
+				}
+			}
+			saveTask(task)
+		}
+		if task.ID > taskID {
+			taskID = task.ID
+		}
+		tasks = append(tasks, task)
+	}
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const TEMPLATE_SETTINGS_DIR = "/template_settings" // 模板设置子目录, 模板内容仍保存在模板目录
+
+// TemplateSettings 是模板文件以外的设置, 按模板类型和文件名保存
+type TemplateSettings struct {
+	RunTimeout           Duration      `json:"run_timeout,omitempty"`           // 覆盖全局 run_timeout
+	InactivityTimeout    Duration      `json:"inactivity_timeout,omitempty"`    // 覆盖全局 run_inactivity_timeout
+	Survey               []SurveyField `json:"survey,omitempty"`                // playbook 模板的调查表, 运行时检查提交的变量
+	AllowExtraVars       bool          `json:"allow_extra_vars,omitempty"`      // 有调查表时仍允许提交调查表以外的变量
+	ExecutionEnvironment string        `json:"execution_environment,omitempty"` // 运行使用的执行环境, 运行请求可以另外指定
+	AnsibleConfig        AnsibleConfig `json:"ansible_cfg,omitempty"`           // 覆盖全局的 ansible.cfg 设置, playbook 模板优先于 inventory 模板
+}
+
+func templateSettingsPath(template PlaybookTemplate) string {
+	return filepath.Join(DATA_DIR, TEMPLATE_SETTINGS_DIR, template.Type, template.Filename+".json")
+}
+
+// validate 检查模板设置
+func (s TemplateSettings) validate() error {
+	if s.RunTimeout < 0 || s.InactivityTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if s.ExecutionEnvironment != "" {
+		if _, ok := findEnvironment(s.ExecutionEnvironment); !ok {
+			return fmt.Errorf("execution environment %q not found", s.ExecutionEnvironment)
+		}
+	}
+	if err := s.AnsibleConfig.validate(); err != nil {
+		return err
+	}
+	return validateSurvey(s.Survey)
+}
+
+func (s TemplateSettings) empty() bool {
+	return s.RunTimeout == 0 && s.InactivityTimeout == 0 && len(s.Survey) == 0 && !s.AllowExtraVars && s.ExecutionEnvironment == "" && len(s.AnsibleConfig) == 0
+}
+
+// saveTemplateSettings 保存模板设置, 没有任何设置时删除设置文件
+func saveTemplateSettings(template PlaybookTemplate) error {
+	path := templateSettingsPath(template)
+	if template.TemplateSettings.empty() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeJSONFile(path, template.TemplateSettings)
+}
+
+// loadTemplateSettings 读取模板设置, 设置文件不存在时返回空设置
+func loadTemplateSettings(template PlaybookTemplate) (TemplateSettings, error) {
+	var settings TemplateSettings
+	data, err := ioutil.ReadFile(templateSettingsPath(template))
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings, fmt.Errorf("invalid template settings for %s: %v", template.Filename, err)
+	}
+	return settings, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TaskStatusTimedOut 表示运行超过最长时间或长时间没有输出, 进程树已被结束
+const TaskStatusTimedOut TaskStatus = "timed_out"
+
+// errRunTimedOut 是运行超时的原因, 用 errors.Is 判断
+var errRunTimedOut = errors.New("run timed out")
+
+// runTimeouts 返回运行的最长时间和无输出超时, 0 表示不限制;
+// 模板设置覆盖全局配置, 请求只能在此基础上缩短
+func runTimeouts(req AnsibleRequest) (time.Duration, time.Duration, error) {
+	if req.Timeout < 0 || req.InactivityTimeout < 0 {
+		return 0, 0, fmt.Errorf("timeouts must not be negative")
+	}
+
+	timeout := time.Duration(serverConfig.RunTimeout)
+	inactivity := time.Duration(serverConfig.RunInactivityTimeout)
+	if req.PlaybookTemplate != "" {
+		if template, ok := findTemplate("playbook", req.PlaybookTemplate); ok {
+			if template.RunTimeout > 0 {
+				timeout = time.Duration(template.RunTimeout)
+			}
+			if template.InactivityTimeout > 0 {
+				inactivity = time.Duration(template.InactivityTimeout)
+			}
+		}
+	}
+	return shorterLimit(timeout, time.Duration(req.Timeout)), shorterLimit(inactivity, time.Duration(req.InactivityTimeout)), nil
+}
+
+// shorterLimit 返回 limit 和请求值中更严格的一个
+func shorterLimit(limit, requested time.Duration) time.Duration {
+	if requested > 0 && (limit == 0 || requested < limit) {
+		return requested
+	}
+	return limit
+}
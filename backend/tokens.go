@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TOKEN_DATA_DIR = "/tokens" // API token 数据子目录
+
+	apiTokenPrefix = "awt_"
+
+	TokenKindPersonal = "personal" // 以创建者身份访问, 权限不超过创建者
+	TokenKindService  = "service"  // 不属于任何用户, 使用 token 自身的角色和权限
+
+	defaultTokenTTL = 90 * 24 * time.Hour
+
+	// 最近使用时间在内存中实时更新, 间隔超过该值才写回磁盘
+	tokenLastUsedSaveInterval = time.Minute
+)
+
+// APIToken 是对外可见的 token 信息, 不包含 token 本身
+type APIToken struct {
+	ID          int          `json:"id"`
+	Name        string       `json:"name"`
+	Kind        string       `json:"kind"`
+	Prefix      string       `json:"prefix"`  // token 的前几位, 便于识别
+	UserID      int          `json:"user_id"` // personal token 的所属用户
+	Username    string       `json:"username,omitempty"`
+	Scopes      []Action     `json:"scopes"`                // 允许的操作, 与用户或 token 自身的权限取交集
+	Role        UserRole     `json:"role,omitempty"`        // service token 的角色
+	Permissions []Permission `json:"permissions,omitempty"` // service token 单独授予的权限
+	ExpiresAt   time.Time    `json:"expires_at"`
+	LastUsedAt  *time.Time   `json:"last_used_at,omitempty"`
+	Revoked     bool         `json:"revoked"`
+	RevokedAt   *time.Time   `json:"revoked_at,omitempty"`
+	CreatedBy   string       `json:"created_by"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// storedAPIToken 是持久化到磁盘的 token, 只保存 token 的 SHA-256
+type storedAPIToken struct {
+	APIToken
+	TokenHash string `json:"token_hash"`
+}
+
+// APITokenRequest 是创建 token 的请求体, ExpiresAt 为空时默认 90 天后过期
+type APITokenRequest struct {
+	Name        string       `json:"name"`
+	Kind        string       `json:"kind"`
+	Scopes      []Action     `json:"scopes"`
+	Role        UserRole     `json:"role"`
+	Permissions []Permission `json:"permissions"`
+	ExpiresAt   *time.Time   `json:"expires_at"`
+}
+
+const tokenContextKey contextKey = "token"
+
+var (
+	apiTokens      []storedAPIToken
+	apiTokenID     int
+	apiTokensMutex sync.Mutex
+	tokenLastSaved = map[int]time.Time{} // 每个 token 最近一次写回磁盘的时间
+)
+
+func apiTokenDataPath(id int) string {
+	return filepath.Join(DATA_DIR, TOKEN_DATA_DIR, strconv.Itoa(id)+".json")
+}
+
+func saveAPITokenFile(token storedAPIToken) error {
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := apiTokenDataPath(token.ID)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 从文件系统加载 API token
+func loadAPITokensFromFiles() error {
+	apiTokens = []storedAPIToken{}
+
+	dir := filepath.Join(DATA_DIR, TOKEN_DATA_DIR)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var token storedAPIToken
+		if err := json.Unmarshal(data, &token); err != nil {
+			fmt.Printf("[Go] 跳过无效的 token 文件 %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if token.ID > apiTokenID {
+			apiTokenID = token.ID
+		}
+		apiTokens = append(apiTokens, token)
+	}
+	return nil
+}
+
+// authenticateAPIToken 校验 API token, 返回 token 代表的用户;
+// personal token 使用所属用户的当前角色和权限, 用户被禁用或删除后 token 失效
+func authenticateAPIToken(raw string) (User, APIToken, bool) {
+	hash := hashToken(raw)
+	now := time.Now()
+
+	apiTokensMutex.Lock()
+	index := -1
+	for i := range apiTokens {
+		if apiTokens[i].TokenHash == hash {
+			index = i
+			break
+		}
+	}
+	if index == -1 || apiTokens[index].Revoked || now.After(apiTokens[index].ExpiresAt) {
+		apiTokensMutex.Unlock()
+		return User{}, APIToken{}, false
+	}
+	apiTokens[index].LastUsedAt = &now
+	token := apiTokens[index]
+	if now.Sub(tokenLastSaved[token.ID]) > tokenLastUsedSaveInterval {
+		tokenLastSaved[token.ID] = now
+		if err := saveAPITokenFile(token); err != nil {
+			fmt.Printf("[Go] 保存 token 文件失败: %v\n", err)
+		}
+	}
+	apiTokensMutex.Unlock()
+
+	if token.Kind == TokenKindService {
+		return User{
+			Username:    "service:" + token.Name,
+			Role:        token.Role,
+			Permissions: token.Permissions,
+		}, token.APIToken, true
+	}
+
+	user, found := findUserByID(token.UserID)
+	if !found || user.Disabled {
+		return User{}, APIToken{}, false
+	}
+	return user, token.APIToken, true
+}
+
+// currentToken 返回请求使用的 API token, 使用会话登录时返回 false
+func currentToken(r *http.Request) (APIToken, bool) {
+	token, ok := r.Context().Value(tokenContextKey).(APIToken)
+	return token, ok
+}
+
+// tokenAllows 判断请求使用的 API token 的 scopes 是否包含该操作, 会话登录不受限制
+func tokenAllows(r *http.Request, action Action) bool {
+	token, ok := currentToken(r)
+	if !ok {
+		return true
+	}
+	for _, scope := range token.Scopes {
+		if scope == action {
+			return true
+		}
+	}
+	return false
+}
+
+func validateAPITokenRequest(req APITokenRequest, owner User) error {
+	if !namePattern.MatchString(req.Name) {
+		return fmt.Errorf("invalid token name")
+	}
+	if len(req.Scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range req.Scopes {
+		if !validActions[scope] {
+			return fmt.Errorf("invalid scope %q", scope)
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("expires_at must be in the future")
+	}
+
+	switch req.Kind {
+	case TokenKindPersonal:
+		if req.Role != "" || len(req.Permissions) > 0 {
+			return fmt.Errorf("personal tokens use the permissions of their owner")
+		}
+	case TokenKindService:
+		// service token 不能管理用户, 也不能拥有 admin 角色
+		if owner.Role != UserRoleAdmin {
+			return fmt.Errorf("only admins can create service tokens")
+		}
+		if req.Role == UserRoleAdmin {
+			return fmt.Errorf("service tokens cannot have the admin role")
+		}
+		if err := validatePermissions(req.Role, req.Permissions); err != nil {
+			return err
+		}
+		for _, scope := range req.Scopes {
+			if scope == ActionManageUsers {
+				return fmt.Errorf("service tokens cannot manage users")
+			}
+		}
+	default:
+		return fmt.Errorf("invalid token kind %q", req.Kind)
+	}
+	return nil
+}
+
+// getAPITokensHandler 列出当前用户的 token, admin 可以看到所有 token
+func getAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, _ := currentUser(r)
+
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+
+	list := make([]APIToken, 0, len(apiTokens))
+	for _, token := range apiTokens {
+		if user.Role == UserRoleAdmin || (token.Kind == TokenKindPersonal && token.UserID == user.ID) {
+			list = append(list, token.APIToken)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// addAPITokenHandler 创建 token, 明文 token 只在响应中返回一次
+func addAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	// 不允许用 token 创建 token, 避免泄露的 token 延长自己的有效期
+	if _, ok := currentToken(r); ok {
+		http.Error(w, "API tokens cannot create tokens", http.StatusForbidden)
+		return
+	}
+
+	var req APITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = TokenKindPersonal
+	}
+	if req.Kind == TokenKindService && req.Role == "" {
+		req.Role = UserRoleViewer
+	}
+	user, _ := currentUser(r)
+	if err := validateAPITokenRequest(req, user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	plain := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	expiresAt := time.Now().Add(defaultTokenTTL)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+
+	token := storedAPIToken{
+		APIToken: APIToken{
+			ID:          apiTokenID + 1,
+			Name:        req.Name,
+			Kind:        req.Kind,
+			Prefix:      plain[:len(apiTokenPrefix)+6],
+			Scopes:      req.Scopes,
+			Role:        req.Role,
+			Permissions: req.Permissions,
+			ExpiresAt:   expiresAt,
+			CreatedBy:   user.Username,
+			CreatedAt:   time.Now(),
+		},
+		TokenHash: hashToken(plain),
+	}
+	if req.Kind == TokenKindPersonal {
+		token.UserID = user.ID
+		token.Username = user.Username
+	}
+	if err := saveAPITokenFile(token); err != nil {
+		fmt.Printf("[Go] 保存 token 文件失败: %v\n", err)
+		http.Error(w, "Failed to save token", http.StatusInternalServerError)
+		return
+	}
+	apiTokenID++
+	apiTokens = append(apiTokens, token)
+	recordAudit(r, "token.add", fmt.Sprintf("token/%d", token.ID), nil, token.APIToken)
+	fmt.Printf("[Go] 用户 %s 创建了 %s token %s\n", user.Username, token.Kind, token.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":     plain,
+		"api_token": token.APIToken,
+	})
+}
+
+// revokeAPITokenHandler 吊销 token, 记录保留以便追溯由该 token 创建的任务
+func revokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	user, _ := currentUser(r)
+
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+
+	for i := range apiTokens {
+		if apiTokens[i].ID != id {
+			continue
+		}
+		token := apiTokens[i]
+		if user.Role != UserRoleAdmin && !(token.Kind == TokenKindPersonal && token.UserID == user.ID) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		if !token.Revoked {
+			before := token.APIToken
+			now := time.Now()
+			token.Revoked = true
+			token.RevokedAt = &now
+			if err := saveAPITokenFile(token); err != nil {
+				fmt.Printf("[Go] 保存 token 文件失败: %v\n", err)
+				http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+				return
+			}
+			apiTokens[i] = token
+			recordAudit(r, "token.revoke", fmt.Sprintf("token/%d", token.ID), before, token.APIToken)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(token.APIToken)
+		return
+	}
+
+	http.Error(w, "Token not found", http.StatusNotFound)
+}
+
+// revokeUserTokens 吊销用户的所有 personal token, 用于删除用户
+func revokeUserTokens(userID int) {
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+
+	now := time.Now()
+	for i := range apiTokens {
+		token := apiTokens[i]
+		if token.Kind != TokenKindPersonal || token.UserID != userID || token.Revoked {
+			continue
+		}
+		token.Revoked = true
+		token.RevokedAt = &now
+		if err := saveAPITokenFile(token); err != nil {
+			fmt.Printf("[Go] 保存 token 文件失败: %v\n", err)
+			continue
+		}
+		apiTokens[i] = token
+	}
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WORKFLOW_DATA_DIR = "/workflows" // 工作流数据子目录
+
+	TaskKindWorkflow = "workflow"
+
+	// 节点在工作流任务中的状态, 执行后为节点任务的状态
+	WorkflowNodePending = "pending"
+	WorkflowNodeRunning = "running"
+	WorkflowNodeSkipped = "skipped" // 没有满足条件的入边
+)
+
+// WorkflowNode 是工作流中的一次 playbook 运行, 结束后按结果触发后续节点
+type WorkflowNode struct {
+	ID                string                 `json:"id"` // 工作流内唯一的节点名称
+	PlaybookTemplate  string                 `json:"playbook_template"`
+	InventoryTemplate string                 `json:"inventory_template"`
+	Variables         map[string]interface{} `json:"variables,omitempty"`
+	Secrets           []string               `json:"secrets,omitempty"`
+	CredentialID      int                    `json:"credential_id,omitempty"`
+	OnSuccess         []string               `json:"on_success,omitempty"` // 成功后执行的节点
+	OnFailure         []string               `json:"on_failure,omitempty"` // 失败或超时后执行的节点, 例如回滚
+	Always            []string               `json:"always,omitempty"`     // 无论结果都执行的节点
+
+	RunOptions
+}
+
+// Workflow 是由多个 playbook 运行组成的有向无环图, 没有入边的节点最先执行
+type Workflow struct {
+	ID          int            `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Nodes       []WorkflowNode `json:"nodes"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+}
+
+// WorkflowRun 是工作流任务中记录的执行状态, 包含完整的图
+type WorkflowRun struct {
+	WorkflowID int               `json:"workflow_id"`
+	Name       string            `json:"name"`
+	Nodes      []WorkflowNodeRun `json:"nodes"`
+}
+
+type WorkflowNodeRun struct {
+	ID                string   `json:"id"`
+	PlaybookTemplate  string   `json:"playbook_template"`
+	InventoryTemplate string   `json:"inventory_template"`
+	OnSuccess         []string `json:"on_success,omitempty"`
+	OnFailure         []string `json:"on_failure,omitempty"`
+	Always            []string `json:"always,omitempty"`
+	Status            string   `json:"status"`
+	TaskID            int      `json:"task_id,omitempty"`
+	Message           string   `json:"message,omitempty"` // 未能创建任务时的原因
+}
+
+var (
+	workflows      []Workflow
+	workflowID     int
+	workflowsMutex sync.Mutex
+)
+
+func workflowDataPath(id int) string {
+	return filepath.Join(DATA_DIR, WORKFLOW_DATA_DIR, fmt.Sprintf("%d.json", id))
+}
+
+func saveWorkflow(workflow Workflow) error {
+	return writeJSONFile(workflowDataPath(workflow.ID), workflow)
+}
+
+func loadWorkflowsFromFiles() error {
+	workflows = []Workflow{}
+
+	dir := filepath.Join(DATA_DIR, WORKFLOW_DATA_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var workflow Workflow
+		if err := json.Unmarshal(data, &workflow); err != nil {
+			fmt.Printf("[Go] 跳过无效的工作流文件 %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if workflow.ID > workflowID {
+			workflowID = workflow.ID
+		}
+		workflows = append(workflows, workflow)
+	}
+
+	sort.Slice(workflows, func(i, j int) bool { return workflows[i].ID < workflows[j].ID })
+	return nil
+}
+
+// request 返回节点对应的运行请求, 模板内容在运行时读取
+func (n WorkflowNode) request() AnsibleRequest {
+	return AnsibleRequest{
+		PlaybookTemplate:  n.PlaybookTemplate,
+		InventoryTemplate: n.InventoryTemplate,
+		Variables:         n.Variables,
+		Secrets:           n.Secrets,
+		CredentialID:      n.CredentialID,
+		RunOptions:        n.RunOptions,
+	}
+}
+
+// edges 返回节点的所有出边指向的节点
+func (n WorkflowNode) edges() []string {
+	return append(append(append([]string{}, n.OnSuccess...), n.OnFailure...), n.Always...)
+}
+
+// validateWorkflow 检查工作流的节点和边, 返回每个节点的运行请求用于权限检查
+func validateWorkflow(workflow Workflow) ([]AnsibleRequest, error) {
+	if !namePattern.MatchString(workflow.Name) {
+		return nil, fmt.Errorf("invalid workflow name")
+	}
+	if len(workflow.Nodes) == 0 {
+		return nil, fmt.Errorf("workflow has no nodes")
+	}
+
+	nodes := map[string]bool{}
+	for _, node := range workflow.Nodes {
+		if !namePattern.MatchString(node.ID) {
+			return nil, fmt.Errorf("invalid node id %q", node.ID)
+		}
+		if nodes[node.ID] {
+			return nil, fmt.Errorf("duplicate node id %q", node.ID)
+		}
+		nodes[node.ID] = true
+	}
+
+	var requests []AnsibleRequest
+	incoming := map[string]int{}
+	for _, node := range workflow.Nodes {
+		if node.PlaybookTemplate == "" || node.InventoryTemplate == "" {
+			return nil, fmt.Errorf("node %s: playbook_template and inventory_template are required", node.ID)
+		}
+		if err := node.RunOptions.validate(); err != nil {
+			return nil, fmt.Errorf("node %s: %v", node.ID, err)
+		}
+		req := node.request()
+		if err := resolveRunTemplates(&req); err != nil {
+			return nil, fmt.Errorf("node %s: %v", node.ID, err)
+		}
+		requests = append(requests, req)
+
+		seen := map[string]bool{}
+		for _, next := range node.edges() {
+			if !nodes[next] {
+				return nil, fmt.Errorf("node %s: unknown node %q", node.ID, next)
+			}
+			if next == node.ID || seen[next] {
+				return nil, fmt.Errorf("node %s: invalid edge to %q", node.ID, next)
+			}
+			seen[next] = true
+			incoming[next]++
+		}
+	}
+
+	// 拓扑排序检查环
+	var ready []string
+	for _, node := range workflow.Nodes {
+		if incoming[node.ID] == 0 {
+			ready = append(ready, node.ID)
+		}
+	}
+	visited := 0
+	for len(ready) > 0 {
+		id := ready[0]
+		ready = ready[1:]
+		visited++
+		for _, next := range workflow.node(id).edges() {
+			if incoming[next]--; incoming[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+	if visited != len(workflow.Nodes) {
+		return nil, fmt.Errorf("workflow contains a cycle")
+	}
+	return requests, nil
+}
+
+func (w Workflow) node(id string) WorkflowNode {
+	for _, node := range w.Nodes {
+		if node.ID == id {
+			return node
+		}
+	}
+	return WorkflowNode{}
+}
+
+// newWorkflowRun 返回所有节点都在等待中的执行状态
+func newWorkflowRun(workflow Workflow) *WorkflowRun {
+	run := &WorkflowRun{WorkflowID: workflow.ID, Name: workflow.Name}
+	for _, node := range workflow.Nodes {
+		run.Nodes = append(run.Nodes, WorkflowNodeRun{
+			ID:                node.ID,
+			PlaybookTemplate:  node.PlaybookTemplate,
+			InventoryTemplate: node.InventoryTemplate,
+			OnSuccess:         node.OnSuccess,
+			OnFailure:         node.OnFailure,
+			Always:            node.Always,
+			Status:            WorkflowNodePending,
+		})
+	}
+	return run
+}
+
+// edgeFires 判断节点以 status 结束时某类出边是否触发
+func edgeFires(edge string, status TaskStatus) bool {
+	switch edge {
+	case "on_success":
+		return status == TaskStatusComplete
+	case "on_failure":
+		return status == TaskStatusFailed || status == TaskStatusTimedOut || status == TaskStatusRejected
+	case "always":
+		return status != TaskStatusCanceled
+	}
+	return false
+}
+
+// workflowNodeResult 是节点执行结束的结果
+type workflowNodeResult struct {
+	node      string
+	taskID    int
+	status    TaskStatus
+	artifacts map[string]interface{}
+	message   string
+}
+
+// runWorkflow 按依赖关系执行工作流的节点, 没有依赖关系的节点并行执行;
+// 节点在所有上游节点结束后, 只要有一条入边触发就执行, 否则跳过
+func runWorkflow(taskID int, workflow Workflow, variables map[string]interface{}, user User, token APIToken) {
+	defer endRun()
+
+	parents := map[string][]string{}
+	for _, node := range workflow.Nodes {
+		for _, next := range node.edges() {
+			parents[next] = append(parents[next], node.ID)
+		}
+	}
+
+	finished := map[string]TaskStatus{} // 跳过的节点记为空状态
+	started := map[string]bool{}
+	fired := map[string]bool{}
+	// 每个节点从触发它的上游节点继承的 artifacts
+	inherited := map[string]map[string]interface{}{}
+	results := make(chan workflowNodeResult)
+	running := 0
+	canceled := false
+
+	setNode := func(id, status string, nodeTaskID int, message string) {
+		updateTask(taskID, func(task *Task) {
+			for i := range task.Workflow.Nodes {
+				if n := &task.Workflow.Nodes[i]; n.ID == id {
+					n.Status = status
+					if nodeTaskID != 0 {
+						n.TaskID = nodeTaskID
+					}
+					n.Message = message
+				}
+			}
+		})
+	}
+
+	for {
+		// 启动所有上游节点已结束的节点, 跳过的节点可能使更多节点就绪, 重复直到没有变化
+		for changed := true; changed && !canceled; {
+			changed = false
+			for _, node := range workflow.Nodes {
+				if started[node.ID] {
+					continue
+				}
+				ready := true
+				for _, parent := range parents[node.ID] {
+					if _, ok := finished[parent]; !ok {
+						ready = false
+					}
+				}
+				if !ready {
+					continue
+				}
+				started[node.ID] = true
+				changed = true
+				if len(parents[node.ID]) > 0 && !fired[node.ID] {
+					finished[node.ID] = ""
+					setNode(node.ID, WorkflowNodeSkipped, 0, "")
+					continue
+				}
+
+				vars := nodeVariables(node, inherited[node.ID], variables)
+				running++
+				setNode(node.ID, WorkflowNodeRunning, 0, "")
+				go func(node WorkflowNode) {
+					results <- runWorkflowNode(taskID, node, vars, user, token)
+				}(node)
+			}
+		}
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		finished[result.node] = result.status
+		setNode(result.node, string(result.status), result.taskID, result.message)
+		if result.status == TaskStatusCanceled {
+			canceled = true
+			continue
+		}
+
+		node := workflow.node(result.node)
+		for edge, targets := range map[string][]string{"on_success": node.OnSuccess, "on_failure": node.OnFailure, "always": node.Always} {
+			if !edgeFires(edge, result.status) {
+				continue
+			}
+			for _, next := range targets {
+				fired[next] = true
+				if inherited[next] == nil {
+					inherited[next] = map[string]interface{}{}
+				}
+				for _, source := range []map[string]interface{}{inherited[result.node], result.artifacts} {
+					for k, v := range source {
+						inherited[next][k] = v
+					}
+				}
+			}
+		}
+	}
+
+	// 汇总状态: 有节点被取消时为已取消; 有失败的节点且没有 on_failure 或 always 出边处理时为失败
+	status := TaskStatusComplete
+	var summary strings.Builder
+	for _, node := range workflow.Nodes {
+		nodeStatus, ok := finished[node.ID]
+		switch {
+		case !ok:
+			fmt.Fprintf(&summary, "%s: not started\n", node.ID)
+			continue
+		case nodeStatus == "":
+			fmt.Fprintf(&summary, "%s: skipped\n", node.ID)
+			continue
+		}
+		fmt.Fprintf(&summary, "%s: %s\n", node.ID, nodeStatus)
+		if nodeStatus == TaskStatusCanceled {
+			status = TaskStatusCanceled
+		} else if status != TaskStatusCanceled && edgeFires("on_failure", nodeStatus) && len(node.OnFailure) == 0 && len(node.Always) == 0 {
+			status = TaskStatusFailed
+		}
+	}
+
+	endTime := time.Now()
+	updateTask(taskID, func(task *Task) {
+		task.Status = status
+		task.Output = summary.String()
+		task.EndTime = &endTime
+		if status == TaskStatusComplete {
+			task.Progress = 100
+		}
+		// 工作流被取消时未启动的节点标记为跳过
+		for i := range task.Workflow.Nodes {
+			if task.Workflow.Nodes[i].Status == WorkflowNodePending {
+				task.Workflow.Nodes[i].Status = WorkflowNodeSkipped
+			}
+		}
+	})
+	fmt.Printf("[Go] 工作流 %s (任务 #%d) 结束: %s\n", workflow.Name, taskID, status)
+	if status == TaskStatusComplete {
+		addNotification(NotificationTypeSuccess, fmt.Sprintf("工作流 %s (任务 #%d) 执行成功", workflow.Name, taskID))
+	} else {
+		addNotification(NotificationTypeError, fmt.Sprintf("工作流 %s (任务 #%d) %s", workflow.Name, taskID, status))
+	}
+}
+
+// nodeVariables 合并节点的变量, 优先级: 节点变量 < 上游 artifacts < 启动工作流时的变量;
+// 节点的 playbook 模板有调查表且不允许额外变量时, 上游 artifacts 和启动时的变量只传入调查表声明的变量
+func nodeVariables(node WorkflowNode, inherited, variables map[string]interface{}) map[string]interface{} {
+	var declared map[string]bool
+	if template, ok := findTemplate("playbook", node.PlaybookTemplate); ok {
+		declared = template.surveyVars()
+	}
+	vars := map[string]interface{}{}
+	for k, v := range node.Variables {
+		vars[k] = v
+	}
+	for _, source := range []map[string]interface{}{inherited, variables} {
+		for k, v := range source {
+			if declared == nil || declared[k] {
+				vars[k] = v
+			}
+		}
+	}
+	return vars
+}
+
+// runWorkflowNode 通过与 /run 相同的流程执行一个节点并等待结束, 需要审批时等待审批和执行完成
+func runWorkflowNode(workflowTaskID int, node WorkflowNode, variables map[string]interface{}, user User, token APIToken) workflowNodeResult {
+	result := workflowNodeResult{node: node.ID, status: TaskStatusFailed}
+	if runsDraining() {
+		result.status = TaskStatusCanceled
+		result.message = "server is shutting down"
+		return result
+	}
+
+	req := node.request()
+	req.Variables = variables
+	if err := resolveRunTemplates(&req); err != nil {
+		result.message = err.Error()
+		return result
+	}
+	// 上游 artifacts 在启动时无法检查, 按合并后的变量重新检查权限
+	if !userCanRun(user, req) {
+		result.message = fmt.Sprintf("user %s is not allowed to run node %s with these variables", user.Username, node.ID)
+		return result
+	}
+	run, err := prepareRun(req)
+	if err != nil {
+		result.message = err.Error()
+		return result
+	}
+	defer run.cleanup()
+
+	task := newRunTask(req, run, user, token)
+	task.WorkflowTaskID = workflowTaskID
+	task.WorkflowNode = node.ID
+	task = createTask(task)
+	result.taskID = task.ID
+	fmt.Printf("[Go] 工作流任务 #%d 的节点 %s 创建新任务 #%d\n", workflowTaskID, node.ID, task.ID)
+
+	dispatchRun(task.ID, req, run, nil)
+	finishedTask, ok := waitForTask(task.ID)
+	if !ok {
+		result.status = TaskStatusCanceled
+		return result
+	}
+	result.status = finishedTask.Status
+	result.artifacts = finishedTask.Artifacts
+	return result
+}
+
+// waitForTask 等待任务结束 (例如等待审批后执行), 服务关闭时返回 false
+func waitForTask(taskID int) (Task, bool) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		task, ok := findTask(taskID)
+		if !ok {
+			return Task{}, false
+		}
+		if taskFinished(task.Status) {
+			return task, true
+		}
+		select {
+		case <-ticker.C:
+		case <-runsContext.Done():
+			return Task{}, false
+		}
+	}
+}
+
+func getWorkflowsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	workflowsMutex.Lock()
+	defer workflowsMutex.Unlock()
+	json.NewEncoder(w).Encode(workflows)
+}
+
+// authorizeWorkflow 检查当前用户可以执行工作流的每个节点
+func authorizeWorkflow(w http.ResponseWriter, r *http.Request, requests []AnsibleRequest) bool {
+	for _, req := range requests {
+		if !authorizeRun(w, r, req) {
+			return false
+		}
+	}
+	return true
+}
+
+func addWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	var workflow Workflow
+	if err := json.NewDecoder(r.Body).Decode(&workflow); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	requests, err := validateWorkflow(workflow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeWorkflow(w, r, requests) {
+		return
+	}
+
+	workflowsMutex.Lock()
+	defer workflowsMutex.Unlock()
+
+	for _, existing := range workflows {
+		if existing.Name == workflow.Name {
+			http.Error(w, "Workflow already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	workflowID++
+	workflow.ID = workflowID
+	workflow.CreatedAt = time.Now()
+	workflow.UpdatedAt = workflow.CreatedAt
+	if err := saveWorkflow(workflow); err != nil {
+		workflowID--
+		fmt.Printf("[Go] 保存工作流失败: %v\n", err)
+		http.Error(w, "Failed to save workflow", http.StatusInternalServerError)
+		return
+	}
+	workflows = append(workflows, workflow)
+	recordAudit(r, "workflow.add", "workflow/"+workflow.Name, nil, workflow)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(workflow)
+}
+
+func updateWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	var updated Workflow
+	if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	requests, err := validateWorkflow(updated)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeWorkflow(w, r, requests) {
+		return
+	}
+
+	workflowsMutex.Lock()
+	defer workflowsMutex.Unlock()
+
+	index := -1
+	for i, existing := range workflows {
+		if existing.ID == updated.ID {
+			index = i
+		} else if existing.Name == updated.Name {
+			http.Error(w, "Workflow already exists", http.StatusConflict)
+			return
+		}
+	}
+	if index < 0 {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+
+	existing := workflows[index]
+	updated.CreatedAt = existing.CreatedAt
+	updated.UpdatedAt = time.Now()
+	if err := saveWorkflow(updated); err != nil {
+		fmt.Printf("[Go] 保存工作流失败: %v\n", err)
+		http.Error(w, "Failed to save workflow", http.StatusInternalServerError)
+		return
+	}
+	workflows[index] = updated
+	recordAudit(r, "workflow.update", "workflow/"+updated.Name, existing, updated)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func deleteWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+
+	workflowsMutex.Lock()
+	defer workflowsMutex.Unlock()
+
+	for i, workflow := range workflows {
+		if workflow.ID != id {
+			continue
+		}
+		if err := os.Remove(workflowDataPath(id)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Go] 删除工作流文件失败: %v\n", err)
+			http.Error(w, "Failed to delete workflow", http.StatusInternalServerError)
+			return
+		}
+		workflows = append(workflows[:i], workflows[i+1:]...)
+		recordAudit(r, "workflow.delete", "workflow/"+workflow.Name, workflow, nil)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "Workflow not found", http.StatusNotFound)
+}
+
+// runWorkflowHandler 启动工作流并立即返回工作流任务, 执行状态通过 /tasks 查看
+func runWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID        int                    `json:"id"`
+		Variables map[string]interface{} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var workflow Workflow
+	found := false
+	workflowsMutex.Lock()
+	for _, existing := range workflows {
+		if existing.ID == req.ID {
+			workflow, found = existing, true
+		}
+	}
+	workflowsMutex.Unlock()
+	if !found {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+
+	// 模板可能在保存工作流之后被修改或删除, 启动前重新检查; 权限按加入启动变量后的请求检查
+	requests, err := validateWorkflow(workflow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	for i, node := range workflow.Nodes {
+		requests[i].Variables = nodeVariables(node, nil, req.Variables)
+	}
+	if !authorizeWorkflow(w, r, requests) {
+		return
+	}
+	if !beginRun() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	user, _ := currentUser(r)
+	apiToken, _ := currentToken(r)
+	task := createTask(Task{
+		Kind:      TaskKindWorkflow,
+		Workflow:  newWorkflowRun(workflow),
+		UserID:    user.ID,
+		Username:  user.Username,
+		TokenID:   apiToken.ID,
+		TokenName: apiToken.Name,
+		Status:    TaskStatusRunning,
+		StartTime: time.Now(),
+		Timestamp: time.Now(),
+	})
+	fmt.Printf("[Go] 用户 %s 启动工作流 %s, 任务 #%d\n", user.Username, workflow.Name, task.ID)
+	recordAudit(r, "workflow.run", fmt.Sprintf("task/%d", task.ID), nil, task)
+
+	go runWorkflow(task.ID, workflow, req.Variables, user, apiToken)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// setupSurveyTemplates 使用只包含测试模板的模板列表
+func setupSurveyTemplates(t *testing.T, list ...PlaybookTemplate) {
+	t.Helper()
+	templatesMutex.Lock()
+	old := templates
+	templates = list
+	templatesMutex.Unlock()
+	t.Cleanup(func() {
+		templatesMutex.Lock()
+		templates = old
+		templatesMutex.Unlock()
+	})
+}
+
+func TestNodeVariables(t *testing.T) {
+	survey := []SurveyField{{Name: "app_version", Type: SurveyTypeString}, {Name: "region", Type: SurveyTypeString}}
+	setupSurveyTemplates(t,
+		PlaybookTemplate{Name: "deploy", Type: "playbook", TemplateSettings: TemplateSettings{Survey: survey}},
+		PlaybookTemplate{Name: "open", Type: "playbook", TemplateSettings: TemplateSettings{Survey: survey, AllowExtraVars: true}},
+		PlaybookTemplate{Name: "plain", Type: "playbook"},
+	)
+
+	artifacts := map[string]interface{}{"app_version": "1.2.3", "build_id": 42}
+	variables := map[string]interface{}{"region": "eu", "ansible_host": "10.0.0.9"}
+	tests := []struct {
+		playbook string
+		want     map[string]interface{}
+	}{
+		{"deploy", map[string]interface{}{"region": "eu", "app_version": "1.2.3"}},
+		{"open", map[string]interface{}{"region": "eu", "app_version": "1.2.3", "build_id": 42, "ansible_host": "10.0.0.9"}},
+		{"plain", map[string]interface{}{"region": "eu", "app_version": "1.2.3", "build_id": 42, "ansible_host": "10.0.0.9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.playbook, func(t *testing.T) {
+			node := WorkflowNode{ID: "n", PlaybookTemplate: tt.playbook, Variables: map[string]interface{}{"region": "us"}}
+			got := nodeVariables(node, artifacts, variables)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("nodeVariables() = %v, want %v", got, tt.want)
+			}
+
+			// 合并后的变量可以通过节点模板的调查表检查
+			req := AnsibleRequest{PlaybookTemplate: tt.playbook, Variables: got}
+			if _, err := applySurvey(&req); err != nil {
+				t.Errorf("applySurvey: %v", err)
+			}
+		})
+	}
+}
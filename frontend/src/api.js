@@ -0,0 +1,5 @@
+// 后端地址, 可通过环境变量 VUE_APP_API_BASE 配置 (例如 .env.local);
+// 前端与后端同源部署时设置为空字符串即可使用相对路径
+export const API_BASE = process.env.VUE_APP_API_BASE !== undefined
+  ? process.env.VUE_APP_API_BASE
+  : 'http://localhost:8080'
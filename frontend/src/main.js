@@ -1,10 +1,29 @@
 import Vue from 'vue'
 import App from './App.vue'
 import router from './router'
+import { API_BASE } from './api'
 
 Vue.config.productionTip = false
 
+// 为所有后端请求附加登录 token, token 失效时通知 App 重新登录
+const originalFetch = window.fetch.bind(window)
+window.fetch = async (url, options = {}) => {
+  if (typeof url === 'string' && url.startsWith(API_BASE)) {
+    const token = localStorage.getItem('ansible_web_token')
+    if (token) {
+      options = { ...options, headers: { ...(options.headers || {}), Authorization: `Bearer ${token}` } }
+    }
+    const response = await originalFetch(url, options)
+    if (response.status === 401 && !url.startsWith(`${API_BASE}/auth/login`)) {
+      localStorage.removeItem('ansible_web_token')
+      window.dispatchEvent(new Event('auth-required'))
+    }
+    return response
+  }
+  return originalFetch(url, options)
+}
+
 new Vue({
   router,
   render: h => h(App)
-}).$mount('#app') 
\ No newline at end of file
+}).$mount('#app') 